@@ -1,21 +1,19 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
-	"fmt"
 	"os"
 	"path/filepath"
-	"syscall"
+	"runtime"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
-
+	"github.com/gentoomaniac/backup-tool/lib/exclude"
+	"github.com/gentoomaniac/backup-tool/lib/fsmeta"
 	"github.com/gentoomaniac/backup-tool/lib/model"
-
-	local "github.com/gentoomaniac/backup-tool/lib/output"
+	"github.com/gentoomaniac/backup-tool/lib/pipeline"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/retention"
 
 	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
 
@@ -24,175 +22,184 @@ import (
 	"github.com/spf13/viper"
 )
 
-func filterFSObjectsByHash(objects []*model.FSObject, hash []byte) *model.FSObject {
-	for _, obj := range objects {
-		if bytes.Compare(obj.Hash, hash) == 0 {
-			return obj
+// backupFilter builds the exclude filter from the command line, patterns are relative to root
+func backupFilter(cmd *cobra.Command, root string) (*exclude.Filter, error) {
+	excludes, _ := cmd.Flags().GetStringArray("exclude")
+	includes, _ := cmd.Flags().GetStringArray("include")
+	excludeFiles, _ := cmd.Flags().GetStringArray("exclude-file")
+	excludeCaches, _ := cmd.Flags().GetBool("exclude-caches")
+	excludeIfPresent, _ := cmd.Flags().GetStringArray("exclude-if-present")
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &exclude.Filter{ExcludeCaches: excludeCaches, ExcludeIfPresent: excludeIfPresent}
+	for _, file := range excludeFiles {
+		patterns, err := exclude.ReadPatterns(file, root)
+		if err != nil {
+			return nil, err
+		}
+		filter.Patterns = append(filter.Patterns, patterns...)
+	}
+	for _, line := range excludes {
+		if pattern, ok := exclude.ParsePattern(line, root); ok {
+			filter.Patterns = append(filter.Patterns, pattern)
+		}
+	}
+	for _, line := range includes {
+		if pattern, ok := exclude.ParsePattern("!"+line, root); ok {
+			filter.Patterns = append(filter.Patterns, pattern)
 		}
 	}
-	return nil
+	return filter, nil
 }
 
-func filePathWalkDir(root string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			files = append(files, path)
-		}
-		return nil
-	})
-	return files, err
+// stdinObject describes data read from stdin as a regular file owned by the current user
+func stdinObject(filename string) *model.FSObject {
+	filename = filepath.Join("/", filename)
+	names := fsmeta.NewNames()
+	return &model.FSObject{
+		Name:      filepath.Base(filename),
+		Path:      filepath.Dir(filename),
+		FileMode:  0644,
+		User:      os.Getuid(),
+		Group:     os.Getgid(),
+		UserName:  names.User(os.Getuid()),
+		GroupName: names.Group(os.Getgid()),
+		ModTime:   time.Now().UnixNano(),
+	}
 }
 
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "create a backup",
-	Long:  ``,
+	Long: `Backs up the files below --path. A .backupignore file excludes paths matching its
+gitignore style patterns in its directory and below.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		blocksize, _ := cmd.Flags().GetInt("blocksize")
-		db, _ := cmd.Flags().GetString("db")
-		blockpath, _ := cmd.Flags().GetString("blockpath")
 		path, _ := cmd.Flags().GetString("path")
-		secret, _ := cmd.Flags().GetString("secret")
-		nonce, _ := cmd.Flags().GetString("nonce")
+		stdin, _ := cmd.Flags().GetBool("stdin")
+		stdinFilename, _ := cmd.Flags().GetString("stdin-filename")
 		backupname, _ := cmd.Flags().GetString("name")
 		backupdescription, _ := cmd.Flags().GetString("description")
+		expireIn, _ := cmd.Flags().GetString("expire-in")
+		force, _ := cmd.Flags().GetBool("force")
+		parallel, _ := cmd.Flags().GetInt("parallel")
 
-		database, _ := sqlite.InitDB(db)
-		log.Debug("DB initialised")
-
-		// encryption / decryption
-		var iv []byte
-		if nonce == "" {
-			iv, _ = aes256.GenerateIV()
-		} else {
-			decodedNonce, _ := base64.StdEncoding.DecodeString(nonce)
-			iv = []byte(decodedNonce)
+		expiration := 0
+		if expireIn != "" {
+			duration, err := retention.ParseDuration(expireIn)
+			if err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+			expiration = int(time.Now().Add(duration).Unix())
 		}
-		log.WithFields(log.Fields{
-			"iv": base64.StdEncoding.EncodeToString(iv),
-		}).Debug("iv loaded")
 
-		var secretBytes []byte
-		if secret == "" {
-			secretBytes, _ = aes256.GenerateSecret()
-		} else {
-			decodedSecret, _ := base64.StdEncoding.DecodeString(secret)
-			secretBytes = []byte(decodedSecret)
+		if stdin == (path != "") {
+			log.Error("either --path or --stdin is required")
+			os.Exit(1)
 		}
-		log.WithFields(log.Fields{
-			"secret": base64.StdEncoding.EncodeToString(secretBytes),
-		}).Debug("secret loaded")
+
+		repo := openRepository(cmd)
+		defer repo.Close()
+		database := repo.DB
 
 		// Backup code
 		backup := &model.Backup{
-			Blocksize:   blocksize,
-			Timestamp:   0,
+			Blocksize:   repo.Config.Blocksize,
+			Timestamp:   int(time.Now().Unix()),
 			Objects:     make([]*model.FSObject, 0),
 			Name:        backupname,
 			Description: backupdescription,
-			Expiration:  999999999,
+			Expiration:  expiration,
+			Chunker:     repo.Config.Chunker,
+			ChunkMin:    repo.Config.ChunkMin,
+			ChunkAvg:    repo.Config.ChunkAvg,
+			ChunkMax:    repo.Config.ChunkMax,
 		}
-
-		pathStat, _ := os.Stat(path)
-
-		var files []string
-		if pathStat.IsDir() {
-			files, _ = filePathWalkDir(path)
-		} else {
-			files = make([]string, 0)
-			files = append(files, path)
+		compression := repo.Config.Compression
+		if err := chunkerSettings(cmd, backup, &compression); err != nil {
+			log.Error(err)
+			repo.Close()
+			os.Exit(1)
+		}
+		if previous := sqlite.GetBackup(database, backupname); previous != nil &&
+			(previous.Chunker != backup.Chunker || previous.Blocksize != backup.Blocksize || previous.ChunkMin != backup.ChunkMin ||
+				previous.ChunkAvg != backup.ChunkAvg || previous.ChunkMax != backup.ChunkMax) {
+			log.Warnf("Chunker settings differ from the previous backup '%s', blocks won't deduplicate against it", backupname)
 		}
 
-		var buffer = make([]byte, blocksize)
-		filehasher := sha256.New()
-
-		for _, file := range files {
-			fmt.Printf("Backing up file %s", file)
-
-			f, err := os.Open(file)
+		var err error
+		backupPipeline := pipeline.New(repo, backup, compression, parallel, force)
+		if stdin {
+			err = backupPipeline.RunReader(stdinObject(stdinFilename), os.Stdin)
+		} else {
+			var files []string
+			var filter *exclude.Filter
+			filter, err = backupFilter(cmd, path)
+			if err == nil {
+				files, err = exclude.Walk(path, filter)
+			}
 			if err != nil {
 				log.Error(err)
-				return
-			}
-			defer f.Close()
-
-			filemeta := &model.FSObject{}
-			filestat, _ := os.Stat(file)
-			filemeta.Name = filepath.Base(file)
-			filemeta.Path, _ = filepath.Abs(filepath.Dir(file))
-			if stat, ok := filestat.Sys().(*syscall.Stat_t); ok {
-				filemeta.User = int(stat.Uid)
-				filemeta.Group = int(stat.Gid)
-			}
-			filemeta.FileMode = filestat.Mode()
-			filesize := filestat.Size()
-
-			for {
-				bytesread, err := f.Read(buffer)
-				if err != nil {
-					break
-				}
-				filesize += int64(bytesread)
-
-				data := buffer[:bytesread]
-
-				blockSecret, _ := aes256.GenerateSecret()
-				hash := sha256.Sum256(data)
-				encryptedHash, _ := aes256.Encrypt(hash[:], blockSecret, iv)
-				aes256.Encrypt(hash[:], blockSecret, iv)
-				blockMetadata := &model.BlockMeta{
-					Hash:   hash[:],
-					Name:   []byte(base64.StdEncoding.EncodeToString(encryptedHash)),
-					Secret: blockSecret,
-					Size:   len(data),
-					IV:     iv,
-				}
-				filehasher.Write(data)
-
-				if sqlite.GetBlockMeta(database, blockMetadata.Hash) == nil {
-					encryptedData, _ := aes256.Encrypt(data, blockSecret, iv)
-					local.Write(encryptedData, blockMetadata, blockpath)
-					sqlite.AddBlockToIndex(database, blockMetadata)
-				}
-				filemeta.Blocks = append(filemeta.Blocks, blockMetadata)
-			}
-
-			hash := filehasher.Sum(nil)
-			filemeta.Hash = hash[:]
-			log.Debugf("File hash: %x", filemeta.Hash)
-			log.Debugf("Filse size: %d", filesize)
-
-			fsObjects := sqlite.GetFSObj(database, filemeta.Name, filemeta.Path)
-			if filterFSObjectsByHash(fsObjects, filemeta.Hash) == nil {
-				sqlite.AddFileToIndex(database, filemeta)
+			} else {
+				err = backupPipeline.Run(files)
 			}
-			backup.Objects = append(backup.Objects, filemeta)
-
-			f.Close()
+		}
+		if err != nil {
+			repo.Close()
+			os.Exit(1)
 		}
 
-		sqlite.AddBackupToIndex(database, backup)
+		manifest, err := repository.NewManifestName()
+		if err == nil {
+			backup.Manifest = manifest
+			_, err = sqlite.AddBackupToIndex(database, backup)
+		}
+		if err == nil {
+			err = repo.WriteManifest(backup)
+		}
+		if err == nil {
+			// older backups may not have a manifest in the block store yet
+			err = repo.SyncManifests(false)
+		}
+		if err != nil {
+			log.Error(err)
+			repo.Close()
+			os.Exit(1)
+		}
+		if skipped := backupPipeline.Skipped(); skipped > 0 {
+			log.Warnf("Skipped %d files that vanished or couldn't be read", skipped)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
-	backupCmd.Flags().IntP("blocksize", "b", 52428800, "Data block size in bytes")
+	addChunkerFlags(backupCmd, false)
 	backupCmd.Flags().StringP("name", "", "", "name of the backup")
 	backupCmd.Flags().StringP("description", "", "", "description for the backup")
+	backupCmd.Flags().IntP("parallel", "j", runtime.NumCPU(), "number of workers hashing, encrypting and uploading blocks")
+	backupCmd.Flags().BoolP("force", "f", false, "read all files, even the ones unchanged since the last backup")
+	backupCmd.Flags().StringP("expire-in", "", "", "let the backup expire after this duration, e.g. 90d (default never)")
 	backupCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
 	backupCmd.Flags().StringP("path", "p", "", "path to backup")
-	backupCmd.Flags().StringP("blockpath", "o", "", "path to store the blocks at")
-	backupCmd.Flags().StringP("secret", "s", "", "secret")
+	backupCmd.Flags().StringArrayP("exclude", "e", nil, "exclude paths matching a gitignore style pattern relative to --path, can be repeated")
+	backupCmd.Flags().StringArrayP("include", "i", nil, "back up paths matching a pattern even if excluded, can't reach into excluded directories")
+	backupCmd.Flags().StringArrayP("exclude-file", "", nil, "read exclude patterns from a file, can be repeated")
+	backupCmd.Flags().BoolP("exclude-caches", "", false, "exclude directories containing a CACHEDIR.TAG")
+	backupCmd.Flags().StringArrayP("exclude-if-present", "", nil, "exclude directories containing this file, can be repeated")
+	backupCmd.Flags().BoolP("stdin", "", false, "back up data read from stdin instead of --path")
+	backupCmd.Flags().StringP("stdin-filename", "", "stdin", "file name to record the data read from stdin under")
+	backupCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
 	backupCmd.Flags().StringP("nonce", "n", "", "IV")
+	backupCmd.Flags().MarkDeprecated("nonce", "every block is encrypted with its own random nonce now")
 	viper.BindPFlag("blocksize", backupCmd.Flags().Lookup("blocksize"))
 	viper.BindPFlag("db", backupCmd.Flags().Lookup("db"))
 	viper.BindPFlag("path", backupCmd.Flags().Lookup("path"))
-	viper.BindPFlag("secret", backupCmd.Flags().Lookup("secret"))
-	viper.BindPFlag("nonce", backupCmd.Flags().Lookup("nonce"))
 
-	backupCmd.MarkFlagRequired("path")
 	backupCmd.MarkFlagRequired("name")
 }
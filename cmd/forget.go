@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/retention"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+func retentionPolicy(cmd *cobra.Command) (*retention.Policy, error) {
+	policy := &retention.Policy{}
+	policy.Last, _ = cmd.Flags().GetInt("keep-last")
+	policy.Hourly, _ = cmd.Flags().GetInt("keep-hourly")
+	policy.Daily, _ = cmd.Flags().GetInt("keep-daily")
+	policy.Weekly, _ = cmd.Flags().GetInt("keep-weekly")
+	policy.Monthly, _ = cmd.Flags().GetInt("keep-monthly")
+	policy.Yearly, _ = cmd.Flags().GetInt("keep-yearly")
+
+	within, _ := cmd.Flags().GetString("keep-within")
+	if within != "" {
+		duration, err := retention.ParseDuration(within)
+		if err != nil {
+			return nil, err
+		}
+		policy.Within = duration
+	}
+	return policy, nil
+}
+
+// forgetCmd represents the forget command
+var forgetCmd = &cobra.Command{
+	Use:     "forget [backup id...]",
+	Aliases: []string{"prune"},
+	Short:   "remove backups and the data only they reference",
+	Long: `Removes expired backups, backups not kept by the --keep-* rules and the backups given by id.
+Files and blocks no remaining backup references are deleted from the index and the block store.
+The rules apply to each backup name separately, without any rule only expired and explicitly given backups are removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		backupname, _ := cmd.Flags().GetString("name")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		policy, err := retentionPolicy(cmd)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		explicit := make(map[int]bool)
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				log.Errorf("Invalid backup id '%s'", arg)
+				os.Exit(1)
+			}
+			explicit[id] = true
+		}
+
+		repo := openRepository(cmd)
+		defer repo.Close()
+
+		backups := make([]*model.Backup, 0)
+		for _, backup := range sqlite.GetBackups(repo.DB) {
+			if backupname == "" || backup.Name == backupname {
+				backups = append(backups, backup)
+			}
+		}
+
+		keep, forget := retention.Apply(policy, backups, time.Now())
+		remove := forget
+		for _, backup := range keep {
+			if explicit[backup.ID] {
+				remove = append(remove, backup)
+			}
+		}
+
+		for _, backup := range remove {
+			reason := "policy"
+			if explicit[backup.ID] {
+				reason = "requested"
+			} else if retention.Expired(backup, time.Now()) {
+				reason = "expired"
+			}
+			fmt.Printf("remove: %d %s %s (%s)\n", backup.ID, backup.Name, formatTimestamp(backup.Timestamp), reason)
+		}
+
+		result, err := repo.RemoveBackups(remove, dryRun)
+		if err != nil {
+			log.Error(err)
+			repo.Close()
+			os.Exit(1)
+		}
+
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%s %d backups, %d files and %d blocks (%d bytes), keeping %d backups\n",
+			verb, result.Backups, result.Files, result.Blocks, result.Bytes, len(backups)-len(remove))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(forgetCmd)
+	forgetCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	forgetCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
+	forgetCmd.Flags().StringP("name", "", "", "only consider backups with this name")
+	forgetCmd.Flags().BoolP("dry-run", "n", false, "only report what would be removed")
+	forgetCmd.Flags().IntP("keep-last", "", 0, "keep the last n backups")
+	forgetCmd.Flags().IntP("keep-hourly", "", 0, "keep the last backup of the last n hours with backups")
+	forgetCmd.Flags().IntP("keep-daily", "", 0, "keep the last backup of the last n days with backups")
+	forgetCmd.Flags().IntP("keep-weekly", "", 0, "keep the last backup of the last n weeks with backups")
+	forgetCmd.Flags().IntP("keep-monthly", "", 0, "keep the last backup of the last n months with backups")
+	forgetCmd.Flags().IntP("keep-yearly", "", 0, "keep the last backup of the last n years with backups")
+	forgetCmd.Flags().StringP("keep-within", "", "", "keep all backups made within this duration of the newest one, e.g. 30d")
+}
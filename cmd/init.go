@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/chunker"
+	"github.com/gentoomaniac/backup-tool/lib/compress"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+// addChunkerFlags adds the flags controlling how data is split and compressed.
+// Without defaults the flags only override the repository config when given.
+func addChunkerFlags(cmd *cobra.Command, withDefaults bool) {
+	suffix := " (overrides the repository config)"
+	blocksize, chunkMin, chunkAvg, chunkMax := 0, 0, 0, 0
+	chunkerName, compression := "", ""
+	if withDefaults {
+		suffix = ""
+		blocksize, chunkMin, chunkAvg, chunkMax = 52428800, 512*1024, 1024*1024, 8*1024*1024
+		chunkerName, compression = chunker.Fixed, "none"
+	}
+
+	cmd.Flags().IntP("blocksize", "b", blocksize, "Data block size in bytes"+suffix)
+	cmd.Flags().StringP("chunker", "", chunkerName, "how to split files into blocks (fixed or fastcdc)"+suffix)
+	cmd.Flags().StringP("compression", "c", compression, "compress blocks before encryption (none, zstd, lz4 or gzip)"+suffix)
+	cmd.Flags().IntP("chunk-min", "", chunkMin, "minimum block size in bytes for the fastcdc chunker"+suffix)
+	cmd.Flags().IntP("chunk-avg", "", chunkAvg, "average block size in bytes for the fastcdc chunker"+suffix)
+	cmd.Flags().IntP("chunk-max", "", chunkMax, "maximum block size in bytes for the fastcdc chunker"+suffix)
+}
+
+// chunkerSettings applies the chunker flags given on the command line to backup and compression and validates the result
+func chunkerSettings(cmd *cobra.Command, backup *model.Backup, compression *string) error {
+	flags := cmd.Flags()
+	if flags.Changed("blocksize") {
+		backup.Blocksize, _ = flags.GetInt("blocksize")
+	}
+	if flags.Changed("chunker") {
+		backup.Chunker, _ = flags.GetString("chunker")
+	}
+	if flags.Changed("chunk-min") {
+		backup.ChunkMin, _ = flags.GetInt("chunk-min")
+	}
+	if flags.Changed("chunk-avg") {
+		backup.ChunkAvg, _ = flags.GetInt("chunk-avg")
+	}
+	if flags.Changed("chunk-max") {
+		backup.ChunkMax, _ = flags.GetInt("chunk-max")
+	}
+	if flags.Changed("compression") {
+		*compression, _ = flags.GetString("compression")
+	}
+
+	if *compression == "none" {
+		*compression = compress.None
+	}
+	if !compress.Valid(*compression) {
+		return fmt.Errorf("unknown compression '%s'", *compression)
+	}
+	if backup.Chunker != chunker.FastCDC {
+		backup.ChunkMin, backup.ChunkAvg, backup.ChunkMax = 0, 0, 0
+	}
+	_, err := chunker.New(nil, backup)
+	return err
+}
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "create a repository",
+	Long: `Creates a repository from an index database and a block store.
+The repository config is kept in the index and encrypted in the block store,
+all other commands only need --db afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, _ := cmd.Flags().GetString("db")
+		blockpath, _ := cmd.Flags().GetString("blockpath")
+
+		backup := &model.Backup{}
+		backup.Blocksize, _ = cmd.Flags().GetInt("blocksize")
+		backup.Chunker, _ = cmd.Flags().GetString("chunker")
+		backup.ChunkMin, _ = cmd.Flags().GetInt("chunk-min")
+		backup.ChunkAvg, _ = cmd.Flags().GetInt("chunk-avg")
+		backup.ChunkMax, _ = cmd.Flags().GetInt("chunk-max")
+		compression, _ := cmd.Flags().GetString("compression")
+		if err := chunkerSettings(cmd, backup, &compression); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		repo, err := repository.Init(db, &repository.Config{
+			Storage:     blockpath,
+			Chunker:     backup.Chunker,
+			Blocksize:   backup.Blocksize,
+			ChunkMin:    backup.ChunkMin,
+			ChunkAvg:    backup.ChunkAvg,
+			ChunkMax:    backup.ChunkMax,
+			Compression: compression,
+		}, passphraseFunc(cmd))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		defer repo.Close()
+
+		fmt.Printf("created repository %s\n", repo.Config.ID)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	addChunkerFlags(initCmd, true)
+	initCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	initCmd.Flags().StringP("blockpath", "o", "", "location to store the blocks at, e.g. file:///srv/blocks or s3://host/bucket (S3 credentials are read from the environment)")
+
+	initCmd.MarkFlagRequired("blockpath")
+}
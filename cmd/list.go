@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+type backupListEntry struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Created     int    `json:"created"`
+	Expires     int    `json:"expires"`
+	Blocksize   int    `json:"blocksize"`
+	Files       int    `json:"files"`
+	Size        int64  `json:"size"`
+}
+
+type fileListEntry struct {
+	Type      string `json:"type"`
+	Path      string `json:"path"`
+	Target    string `json:"target,omitempty"`
+	Mode      string `json:"mode"`
+	User      int    `json:"uid"`
+	Group     int    `json:"gid"`
+	UserName  string `json:"user,omitempty"`
+	GroupName string `json:"group,omitempty"`
+	Hash      string `json:"hash"`
+}
+
+func formatTimestamp(timestamp int) string {
+	return time.Unix(int64(timestamp), 0).Format(time.RFC3339)
+}
+
+func formatExpiration(timestamp int) string {
+	if timestamp == 0 {
+		return "never"
+	}
+	return formatTimestamp(timestamp)
+}
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Error(err)
+	}
+}
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list backups and their contents",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, _ := cmd.Flags().GetString("db")
+		backupname, _ := cmd.Flags().GetString("name")
+		files, _ := cmd.Flags().GetBool("files")
+		output, _ := cmd.Flags().GetString("output")
+
+		if output != "table" && output != "json" {
+			log.Errorf("Unknown output format '%s'", output)
+			os.Exit(1)
+		}
+
+		database, _ := sqlite.InitDB(db)
+		log.Debug("DB initialised")
+
+		if files {
+			backup, err := selectBackup(cmd, database)
+			if err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+
+			entries := make([]fileListEntry, 0)
+			for _, obj := range sqlite.GetBackupObjects(database, backup.ID) {
+				entries = append(entries, fileListEntry{
+					Type:      obj.Type,
+					Path:      filepath.Join(obj.Path, obj.Name),
+					Target:    obj.Target,
+					Mode:      obj.FileMode.String(),
+					User:      obj.User,
+					Group:     obj.Group,
+					UserName:  obj.UserName,
+					GroupName: obj.GroupName,
+					Hash:      hex.EncodeToString(obj.Hash),
+				})
+			}
+
+			if output == "json" {
+				printJSON(entries)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "MODE\tUID\tGID\tHASH\tPATH")
+			for _, entry := range entries {
+				path := entry.Path
+				if entry.Target != "" {
+					path += " -> " + entry.Target
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", entry.Mode, entry.User, entry.Group, entry.Hash, path)
+			}
+			w.Flush()
+			return
+		}
+
+		entries := make([]backupListEntry, 0)
+		for _, backup := range sqlite.GetBackups(database) {
+			if backupname != "" && backup.Name != backupname {
+				continue
+			}
+			fileCount, size := sqlite.GetBackupStats(database, backup.ID)
+			entries = append(entries, backupListEntry{
+				ID:          backup.ID,
+				Name:        backup.Name,
+				Description: backup.Description,
+				Created:     backup.Timestamp,
+				Expires:     backup.Expiration,
+				Blocksize:   backup.Blocksize,
+				Files:       fileCount,
+				Size:        size,
+			})
+		}
+
+		if output == "json" {
+			printJSON(entries)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tCREATED\tEXPIRES\tBLOCKSIZE\tFILES\tSIZE\tDESCRIPTION")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", entry.ID, entry.Name, formatTimestamp(entry.Created),
+				formatExpiration(entry.Expires), entry.Blocksize, entry.Files, entry.Size, entry.Description)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().StringP("name", "", "", "name of the backup")
+	listCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	listCmd.Flags().IntP("id", "", 0, "ID of the backup as shown by list, used by --files instead of the newest backup of --name")
+	listCmd.Flags().BoolP("files", "f", false, "list the files contained in the backup given by --id or the newest one of --name")
+	listCmd.Flags().StringP("output", "", "table", "output format (table or json)")
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "rewrite blocks stored in an old format",
+	Long: `Rewrites all blocks that were written before every block got its own nonce
+or before blocks were identified by a keyed hash. Each block is stored under a
+new name first and the old one is only removed once the index points to the new
+copy. Blocks already named by their keyed hash get a random name, so their old
+copy is never overwritten. An interrupted run can simply be restarted; a copy
+written just before the interruption shows up as orphaned in verify and can be
+deleted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repo := openRepository(cmd)
+		defer repo.Close()
+
+		migrated, failed := 0, 0
+		for _, block := range sqlite.GetBlocks(repo.DB) {
+			if block.Format != repository.BlockFormatRaw && block.HashType == repository.HashTypeHMAC {
+				continue
+			}
+
+			data, err := repo.ReadBlock(block)
+			if err != nil {
+				log.Errorf("Can't read block %x: %s", block.Name, err)
+				failed++
+				continue
+			}
+			if !bytes.Equal(repo.BlockHash(block.HashType, data), block.Hash) {
+				log.Errorf("Block %x doesn't match its hash", block.Name)
+				failed++
+				continue
+			}
+			secret, err := repo.UnwrapSecret(block.Secret)
+			if err != nil {
+				failed++
+				continue
+			}
+
+			oldName, newName := storage.BlockName(block), ""
+			hash := repo.BlockHash(repository.HashTypeHMAC, data)
+			if existing := sqlite.GetBlockMeta(repo.DB, hash); existing != nil && existing.ID != block.ID {
+				// the same content is already stored under its keyed identifier
+				if err = sqlite.ReplaceBlock(repo.DB, block.ID, existing.ID); err != nil {
+					failed++
+					continue
+				}
+				newName = storage.BlockName(existing)
+			} else {
+				block.Secret = secret
+				block.Hash = hash
+				block.Name = hash
+				block.HashType = repository.HashTypeHMAC
+				if oldName == hex.EncodeToString(hash) {
+					// writing under the old name would replace the copy the index still points to
+					if block.Name, err = repository.NewBlockName(); err != nil {
+						failed++
+						continue
+					}
+				}
+				if err = repo.WriteBlock(block, data, block.Compression); err != nil {
+					failed++
+					continue
+				}
+				if err = sqlite.UpdateBlock(repo.DB, block); err != nil {
+					failed++
+					continue
+				}
+				newName = storage.BlockName(block)
+			}
+
+			if oldName != newName {
+				if err = repo.Storage.Delete(oldName); err != nil {
+					log.Warnf("Can't remove old block %s: %s", oldName, err)
+				}
+			}
+			migrated++
+		}
+
+		fmt.Printf("migrated %d blocks, %d failed\n", migrated, failed)
+		if migrated > 0 {
+			if err := repo.SyncManifests(true); err != nil {
+				log.Error(err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			repo.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	migrateCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/mount"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+// mountCmd represents the mount command
+var mountCmd = &cobra.Command{
+	Use:   "mount <mountpoint>",
+	Short: "mount the backups as a read only filesystem",
+	Long: `Mounts every backup as /<backup name>/<backup ID>/<original path> below the
+mountpoint, using the IDs shown by list. /<backup name>/latest links to the newest
+backup of that name. Only the blocks of files actually read are fetched and decrypted.
+Runs until the filesystem is unmounted or the command is interrupted.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheSize, _ := cmd.Flags().GetInt("cache-size")
+		allowOther, _ := cmd.Flags().GetBool("allow-other")
+		debug, _ := cmd.Flags().GetBool("debug-fuse")
+
+		repo := openRepository(cmd)
+		defer repo.Close()
+
+		server, err := mount.Mount(args[0], repo, mount.Options{CacheSize: cacheSize << 20, AllowOther: allowOther, Debug: debug})
+		if err != nil {
+			repo.Close()
+			os.Exit(1)
+		}
+		fmt.Printf("Mounted backups at %s\n", args[0])
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			if err := server.Unmount(); err != nil {
+				log.Errorf("Can't unmount %s: %s", args[0], err)
+			}
+		}()
+		server.Wait()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mountCmd)
+	mountCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	mountCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
+	mountCmd.Flags().IntP("cache-size", "", 64, "MiB of decrypted blocks to keep in memory")
+	mountCmd.Flags().BoolP("allow-other", "", false, "let other users access the mount, needs user_allow_other in /etc/fuse.conf unless run as root")
+	mountCmd.Flags().BoolP("debug-fuse", "", false, "log every FUSE request")
+}
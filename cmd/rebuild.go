@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+// rebuildCmd represents the rebuild-index command
+var rebuildCmd = &cobra.Command{
+	Use:   "rebuild-index",
+	Short: "recreate a lost index from the block store",
+	Long: `Recreates the index from the repository config and the backup manifests
+kept in the block store. Only the passphrase is needed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, _ := cmd.Flags().GetString("db")
+		blockpath, _ := cmd.Flags().GetString("blockpath")
+
+		if _, err := os.Stat(db); err == nil {
+			log.Errorf("%s already exists, refusing to overwrite it", db)
+			os.Exit(1)
+		}
+
+		repo, err := repository.Rebuild(db, blockpath, passphraseFunc(cmd))
+		if err != nil {
+			log.Error(err)
+			os.Remove(db)
+			os.Exit(1)
+		}
+		defer repo.Close()
+
+		blocks := sqlite.GetBlocks(repo.DB)
+		known := make(map[string]bool)
+		for _, block := range blocks {
+			known[storage.BlockName(block)] = true
+		}
+		names, err := repo.Storage.List()
+		if err != nil {
+			repo.Close()
+			os.Exit(1)
+		}
+		unreferenced := 0
+		for _, name := range names {
+			if storage.IsBlockName(name) && !known[name] {
+				unreferenced++
+			}
+		}
+
+		fmt.Printf("rebuilt index of repository %s: %d backups, %d blocks\n", repo.Config.ID, len(sqlite.GetBackups(repo.DB)), len(blocks))
+		if unreferenced > 0 {
+			fmt.Printf("%d blocks in the store aren't part of any backup manifest and can't be recovered\n", unreferenced)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rebuildCmd)
+	rebuildCmd.Flags().StringP("db", "d", "backup.db", "Database file to create")
+	rebuildCmd.Flags().StringP("blockpath", "o", "", "location of the block store, e.g. file:///srv/blocks")
+
+	rebuildCmd.MarkFlagRequired("blockpath")
+}
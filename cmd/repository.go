@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+
+	_ "github.com/gentoomaniac/backup-tool/lib/storage/local"
+	_ "github.com/gentoomaniac/backup-tool/lib/storage/s3"
+	_ "github.com/gentoomaniac/backup-tool/lib/storage/sftp"
+)
+
+func readPassphrase(cmd *cobra.Command, confirm bool) ([]byte, error) {
+	passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+	if passphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+
+	if passphrase := os.Getenv("BACKUP_TOOL_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("no passphrase given, use --passphrase-file or BACKUP_TOOL_PASSPHRASE")
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+func passphraseFunc(cmd *cobra.Command) repository.PassphraseFunc {
+	return func(confirm bool) ([]byte, error) {
+		return readPassphrase(cmd, confirm)
+	}
+}
+
+// openRepository opens the repository given by the --db and --blockpath flags
+func openRepository(cmd *cobra.Command) *repository.Repository {
+	db, _ := cmd.Flags().GetString("db")
+	blockpath, _ := cmd.Flags().GetString("blockpath")
+
+	repo, err := repository.Open(db, blockpath, passphraseFunc(cmd))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Debugf("Opened repository %s", repo.Config.ID)
+	return repo
+}
+
+// selectBackup returns the backup given by the --id flag, or the newest one of the --name flag
+func selectBackup(cmd *cobra.Command, database *sql.DB) (*model.Backup, error) {
+	backupname, _ := cmd.Flags().GetString("name")
+	id, _ := cmd.Flags().GetInt("id")
+
+	if id > 0 {
+		backup := sqlite.GetBackupByID(database, id)
+		if backup == nil || (backupname != "" && backup.Name != backupname) {
+			return nil, fmt.Errorf("no backup found with id %d", id)
+		}
+		return backup, nil
+	}
+	if backupname == "" {
+		return nil, errors.New("either --name or --id is required")
+	}
+	backup := sqlite.GetBackup(database, backupname)
+	if backup == nil {
+		return nil, fmt.Errorf("no backup found with name '%s'", backupname)
+	}
+	return backup, nil
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/fsmeta"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/sparse"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+var errHashMismatch = errors.New("file hash mismatch")
+
+// writeFileContents writes the blocks of obj to w, fills in the holes of sparse files and checks the file hash
+func writeFileContents(repo *repository.Repository, obj *model.FSObject, w *sparse.Writer) error {
+	// files backed up before keyed hashes were introduced carry a plain hash
+	filehasher := repo.NewFileHasher()
+	plainhasher := sha256.New()
+	for _, block := range sqlite.GetFileBlocks(repo.DB, obj.ID) {
+		data, err := repo.ReadBlock(block)
+		if err != nil {
+			return err
+		}
+		filehasher.Write(data)
+		plainhasher.Write(data)
+
+		_, err = w.Write(data)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	if err := w.Finish(obj.Size); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !bytes.Equal(filehasher.Sum(nil), obj.Hash) && !bytes.Equal(plainhasher.Sum(nil), obj.Hash) {
+		return errHashMismatch
+	}
+	return nil
+}
+
+func restoreFile(repo *repository.Repository, obj *model.FSObject, target string, options fsmeta.Options) error {
+	destination := filepath.Join(target, obj.Path, obj.Name)
+	fmt.Printf("Restoring file %s\n", destination)
+
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	f, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer f.Close()
+
+	w, err := sparse.NewFileWriter(f, obj.Holes)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	err = writeFileContents(repo, obj, w)
+	if err == errHashMismatch {
+		log.Warnf("File hash mismatch for %s: %x", destination, obj.Hash)
+	} else if err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		log.Error(err)
+		return err
+	}
+	return fsmeta.Apply(destination, obj, options)
+}
+
+// restoreObject recreates a backed up object below target. The metadata of directories
+// is left to the caller, it has to be applied once everything inside them is restored.
+func restoreObject(repo *repository.Repository, obj *model.FSObject, target string, options fsmeta.Options) error {
+	destination := filepath.Join(target, obj.Path, obj.Name)
+
+	switch obj.Type {
+	case model.TypeFile, "":
+		return restoreFile(repo, obj, target, options)
+	case model.TypeDir:
+		fmt.Printf("Restoring directory %s\n", destination)
+		err := os.MkdirAll(destination, 0700)
+		if err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+
+	fmt.Printf("Restoring %s %s\n", obj.Type, destination)
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if err = os.Remove(destination); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		return err
+	}
+
+	switch obj.Type {
+	case model.TypeSymlink:
+		err = os.Symlink(obj.Target, destination)
+	case model.TypeBlockDevice:
+		err = syscall.Mknod(destination, syscall.S_IFBLK|uint32(obj.FileMode.Perm()), int(obj.Device))
+	case model.TypeCharDevice:
+		err = syscall.Mknod(destination, syscall.S_IFCHR|uint32(obj.FileMode.Perm()), int(obj.Device))
+	case model.TypeFIFO:
+		err = syscall.Mkfifo(destination, uint32(obj.FileMode.Perm()))
+	case model.TypeSocket:
+		err = syscall.Mknod(destination, syscall.S_IFSOCK|uint32(obj.FileMode.Perm()), 0)
+	default:
+		err = fmt.Errorf("unknown type '%s' of %s", obj.Type, destination)
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return fsmeta.Apply(destination, obj, options)
+}
+
+// restoreLink recreates a hard link to the already restored file first
+func restoreLink(first string, obj *model.FSObject, target string) error {
+	destination := filepath.Join(target, obj.Path, obj.Name)
+	fmt.Printf("Restoring hard link %s\n", destination)
+
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err == nil {
+		err = os.Remove(destination)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Link(first, destination)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+// findFile returns the object of a backup with the given path. A file name is enough if it's unique.
+func findFile(objects []*model.FSObject, file string) (*model.FSObject, error) {
+	if file == "" {
+		if len(objects) == 1 {
+			return objects[0], nil
+		}
+		return nil, fmt.Errorf("backup holds %d files, select one with --file", len(objects))
+	}
+
+	var matches []*model.FSObject
+	for _, obj := range objects {
+		if filepath.Join(obj.Path, obj.Name) == file {
+			return obj, nil
+		}
+		if obj.Name == file {
+			matches = append(matches, obj)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%d files named '%s', give the full path", len(matches), file)
+	}
+	return nil, fmt.Errorf("no file '%s' in the backup", file)
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore a backup",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		target, _ := cmd.Flags().GetString("target")
+		stdout, _ := cmd.Flags().GetBool("stdout")
+		file, _ := cmd.Flags().GetString("file")
+		noTimes, _ := cmd.Flags().GetBool("no-times")
+		noXattrs, _ := cmd.Flags().GetBool("no-xattrs")
+		noACLs, _ := cmd.Flags().GetBool("no-acls")
+		noCapabilities, _ := cmd.Flags().GetBool("no-capabilities")
+		ownerBy, _ := cmd.Flags().GetString("owner-by")
+		mapUsers, _ := cmd.Flags().GetStringArray("map-user")
+		mapGroups, _ := cmd.Flags().GetStringArray("map-group")
+		options := fsmeta.Options{Times: !noTimes, Xattrs: !noXattrs, ACLs: !noACLs, Capabilities: !noCapabilities}
+
+		owners, err := fsmeta.NewOwners(ownerBy, mapUsers, mapGroups)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		options.Owners = owners
+
+		if !stdout && target == "" {
+			log.Error("--target is required unless restoring to --stdout")
+			os.Exit(1)
+		}
+
+		repo := openRepository(cmd)
+		defer repo.Close()
+
+		backup, err := selectBackup(cmd, repo.DB)
+		if err != nil {
+			log.Error(err)
+			repo.Close()
+			os.Exit(1)
+		}
+		backup.Objects = sqlite.GetBackupObjects(repo.DB, backup.ID)
+
+		if stdout {
+			obj, err := findFile(backup.Objects, file)
+			if err == nil {
+				err = writeFileContents(repo, obj, sparse.NewWriter(os.Stdout, obj.Holes))
+			}
+			if err != nil {
+				log.Error(err)
+				repo.Close()
+				os.Exit(1)
+			}
+			return
+		}
+
+		failed := 0
+		dirs := make([]*model.FSObject, 0)
+		// first restored path of each hard linked file by device and inode
+		links := make(map[[2]uint64]string)
+		for _, obj := range backup.Objects {
+			key := [2]uint64{obj.DeviceID, obj.Inode}
+			if obj.Type != model.TypeDir && obj.Links > 1 {
+				if first, ok := links[key]; ok {
+					if err := restoreLink(first, obj, target); err != nil {
+						failed++
+					}
+					continue
+				}
+			}
+
+			if err := restoreObject(repo, obj, target, options); err != nil {
+				failed++
+			} else if obj.Type == model.TypeDir {
+				dirs = append(dirs, obj)
+			} else if obj.Links > 1 {
+				links[key] = filepath.Join(target, obj.Path, obj.Name)
+			}
+		}
+		// innermost directories first, a read only parent would stop the others
+		// and restoring their contents changed the times
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := fsmeta.Apply(filepath.Join(target, dirs[i].Path, dirs[i].Name), dirs[i], options); err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			log.Errorf("Failed to restore %d of %d files", failed, len(backup.Objects))
+			repo.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringP("name", "", "", "name of the backup, the newest one with this name is restored unless --id is given")
+	restoreCmd.Flags().IntP("id", "", 0, "ID of the backup to restore as shown by list")
+	restoreCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	restoreCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
+	restoreCmd.Flags().StringP("target", "t", "", "directory to restore the files into")
+	restoreCmd.Flags().BoolP("stdout", "", false, "write the contents of a single file to stdout instead")
+	restoreCmd.Flags().StringP("file", "", "", "path or name of the file to write to stdout, not needed if the backup holds only one")
+
+	restoreCmd.Flags().BoolP("no-times", "", false, "don't restore access and modification times")
+	restoreCmd.Flags().BoolP("no-xattrs", "", false, "don't restore extended attributes other than ACLs and capabilities")
+	restoreCmd.Flags().BoolP("no-acls", "", false, "don't restore POSIX ACLs")
+	restoreCmd.Flags().BoolP("no-capabilities", "", false, "don't restore file capabilities")
+	restoreCmd.Flags().StringP("owner-by", "", fsmeta.OwnerByName, "restore owners by recorded user and group name or by numeric id, names without a local account fall back to the id")
+	restoreCmd.Flags().StringArrayP("map-user", "", nil, "restore files of a recorded user name or uid as another one, old:new, can be repeated")
+	restoreCmd.Flags().StringArrayP("map-group", "", nil, "restore files of a recorded group name or gid as another one, old:new, can be repeated")
+
+}
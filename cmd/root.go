@@ -45,6 +45,7 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.backup-tool.yaml)")
+	rootCmd.PersistentFlags().String("passphrase-file", "", "file containing the repository passphrase (default is $BACKUP_TOOL_PASSPHRASE or a prompt)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -77,6 +78,6 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		log.Debugf("Using config file: %s", viper.ConfigFileUsed())
 	}
 }
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+func parseSample(sample string) (float64, error) {
+	percentage, err := strconv.ParseFloat(strings.TrimSuffix(sample, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percentage <= 0 || percentage > 100 {
+		return 0, fmt.Errorf("sample must be between 0%% and 100%%: %s", sample)
+	}
+	return percentage, nil
+}
+
+func sampleBlocks(blocks []*model.BlockMeta, percentage float64) []*model.BlockMeta {
+	count := int(float64(len(blocks))*percentage/100 + 0.5)
+	if count < 1 && len(blocks) > 0 {
+		count = 1
+	}
+
+	rand.Shuffle(len(blocks), func(i, j int) { blocks[i], blocks[j] = blocks[j], blocks[i] })
+	return blocks[:count]
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "verify the block store against the index",
+	Long: `Reads every block in the index and checks its hash, then lists the block store
+for blocks the index doesn't know about. Missing, corrupt and orphaned blocks make
+the command fail. With --sample only a random part of the blocks is read and the
+store isn't listed for orphans.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sample, _ := cmd.Flags().GetString("sample")
+
+		percentage, err := parseSample(sample)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		repo := openRepository(cmd)
+		defer repo.Close()
+
+		blocks := sqlite.GetBlocks(repo.DB)
+		known := make(map[string]bool)
+		for _, block := range blocks {
+			known[storage.BlockName(block)] = true
+		}
+		if percentage < 100 {
+			blocks = sampleBlocks(blocks, percentage)
+		}
+
+		missing, corrupt, orphaned := 0, 0, 0
+		for _, block := range blocks {
+			data, err := repo.ReadBlock(block)
+			if err == storage.ErrNotExist {
+				fmt.Printf("missing: %x\n", block.Name)
+				missing++
+				continue
+			}
+			if err != nil {
+				fmt.Printf("corrupt: %x (%s)\n", block.Name, err)
+				corrupt++
+				continue
+			}
+
+			if !bytes.Equal(repo.BlockHash(block.HashType, data), block.Hash) || len(data) != block.Size {
+				fmt.Printf("corrupt: %x (hash or size mismatch)\n", block.Name)
+				corrupt++
+			}
+		}
+
+		// listing the whole store is as expensive as the full check, sampled runs leave it out
+		if percentage == 100 {
+			names, err := repo.Storage.List()
+			if err != nil {
+				repo.Close()
+				os.Exit(1)
+			}
+			for _, name := range names {
+				if storage.IsBlockName(name) && !known[name] {
+					fmt.Printf("orphaned: %s\n", name)
+					orphaned++
+				}
+			}
+			fmt.Printf("checked %d blocks: %d missing, %d corrupt, %d orphaned\n", len(blocks), missing, corrupt, orphaned)
+		} else {
+			fmt.Printf("checked %d blocks: %d missing, %d corrupt, orphans not checked in a sample\n", len(blocks), missing, corrupt)
+		}
+
+		if missing > 0 || corrupt > 0 || orphaned > 0 {
+			repo.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringP("db", "d", "backup.db", "Database file with backup meta information")
+	verifyCmd.Flags().StringP("blockpath", "o", "", "override the block location recorded in the repository, e.g. file:///srv/blocks")
+	verifyCmd.Flags().StringP("sample", "", "100%", "percentage of blocks to check, e.g. 10%, orphaned blocks are only looked for at 100%")
+}
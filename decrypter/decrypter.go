@@ -22,7 +22,7 @@ func getenv(name string, defaultValue string) string {
 var (
 	verbose = kingpin.Flag("verbose", "Verbose mode.").Short('v').Bool()
 	secret  = kingpin.Flag("secret", "Secret").Short('s').Required().String()
-	nonce   = kingpin.Flag("nonce", "Secret").Short('n').Required().String()
+	nonce   = kingpin.Flag("nonce", "Nonce of blocks written before nonces were prefixed to the block").Short('n').String()
 )
 
 func decrypt(ciphertext []byte, key []byte, nonce []byte) (decryptedData []byte) {
@@ -55,6 +55,16 @@ func main() {
 
 	encryptedData, _ := ioutil.ReadAll(os.Stdin)
 	key, _ := base64.StdEncoding.DecodeString(*secret)
-	iv, _ := base64.StdEncoding.DecodeString(*nonce)
+
+	// current blocks start with their nonce, only old ones need it passed in
+	var iv []byte
+	if *nonce == "" {
+		if len(encryptedData) < 12 {
+			log.Fatal("block too short")
+		}
+		iv, encryptedData = encryptedData[:12], encryptedData[12:]
+	} else {
+		iv, _ = base64.StdEncoding.DecodeString(*nonce)
+	}
 	os.Stdout.Write(decrypt(encryptedData, key, iv))
 }
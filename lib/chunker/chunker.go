@@ -0,0 +1,36 @@
+package chunker
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+const (
+	// Fixed splits data into blocks of the backup blocksize
+	Fixed = "fixed"
+	// FastCDC splits data at content defined boundaries found with a gear rolling hash
+	FastCDC = "fastcdc"
+
+	// initialBufferSize is what the chunkers start reading with, their buffers only grow
+	// towards the block size for files that big, so small files stay cheap
+	initialBufferSize = 64 * 1024
+)
+
+// Chunker splits a stream into blocks.
+// Next returns io.EOF once the stream is exhausted, the returned slices are never reused.
+type Chunker interface {
+	Next() ([]byte, error)
+}
+
+// New returns the chunker configured for backup reading from r
+func New(r io.Reader, backup *model.Backup) (Chunker, error) {
+	switch backup.Chunker {
+	case Fixed, "":
+		return NewFixed(r, backup.Blocksize)
+	case FastCDC:
+		return NewFastCDC(r, backup.ChunkMin, backup.ChunkAvg, backup.ChunkMax)
+	}
+	return nil, fmt.Errorf("unknown chunker '%s'", backup.Chunker)
+}
@@ -0,0 +1,170 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// chunks returns all blocks c cuts
+func chunks(t *testing.T, c Chunker) [][]byte {
+	t.Helper()
+	var blocks [][]byte
+	for {
+		block, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	if _, err := c.Next(); err != io.EOF {
+		t.Errorf("Next after the end returned %v, want io.EOF", err)
+	}
+	return blocks
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestFixed(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		input   int
+		lengths []int
+	}{
+		{"empty", 100, 0, nil},
+		{"shorter than a block", 100, 42, []int{42}},
+		{"exact block", 100, 100, []int{100}},
+		{"exact multiple", 100, 300, []int{100, 100, 100}},
+		{"short tail", 100, 250, []int{100, 100, 50}},
+		{"block bigger than the initial buffer", 3*initialBufferSize + 5, 7*initialBufferSize + 1,
+			[]int{3*initialBufferSize + 5, 3*initialBufferSize + 5, initialBufferSize - 9}},
+	}
+	for _, test := range tests {
+		data := randomData(test.input, 1)
+		c, err := NewFixed(bytes.NewReader(data), test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks := chunks(t, c)
+
+		if len(blocks) != len(test.lengths) {
+			t.Errorf("%s: got %d blocks, want %d", test.name, len(blocks), len(test.lengths))
+			continue
+		}
+		for i, block := range blocks {
+			if len(block) != test.lengths[i] {
+				t.Errorf("%s: block %d is %d bytes, want %d", test.name, i, len(block), test.lengths[i])
+			}
+		}
+		if !bytes.Equal(bytes.Join(blocks, nil), data) {
+			t.Errorf("%s: blocks don't add up to the input", test.name)
+		}
+	}
+}
+
+func TestFixedInvalidSize(t *testing.T) {
+	if _, err := NewFixed(bytes.NewReader(nil), 0); err == nil {
+		t.Error("NewFixed accepted a blocksize of 0")
+	}
+}
+
+// oneByteReader returns at most one byte per Read, like a slow pipe
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestFixedShortReads(t *testing.T) {
+	data := randomData(1000, 2)
+	c, _ := NewFixed(oneByteReader{bytes.NewReader(data)}, 300)
+	blocks := chunks(t, c)
+	if len(blocks) != 4 || len(blocks[0]) != 300 || len(blocks[3]) != 100 {
+		t.Errorf("short reads changed the blocks")
+	}
+}
+
+const (
+	testMin = 2 * 1024
+	testAvg = 8 * 1024
+	testMax = 32 * 1024
+)
+
+func fastCDCChunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c, err := NewFastCDC(bytes.NewReader(data), testMin, testAvg, testMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks(t, c)
+}
+
+func TestFastCDCSizes(t *testing.T) {
+	for _, size := range []int{0, 1, testMin, testMin + 1, testMax, 2 * 1024 * 1024} {
+		data := randomData(size, int64(size))
+		blocks := fastCDCChunks(t, data)
+
+		for i, block := range blocks {
+			last := i == len(blocks)-1
+			if len(block) > testMax || (len(block) < testMin && !last) || len(block) == 0 {
+				t.Errorf("input of %d bytes: block %d of %d is %d bytes", size, i, len(blocks), len(block))
+			}
+		}
+		if !bytes.Equal(bytes.Join(blocks, nil), data) {
+			t.Errorf("input of %d bytes: blocks don't add up to the input", size)
+		}
+	}
+}
+
+func TestFastCDCAverage(t *testing.T) {
+	data := randomData(4*1024*1024, 3)
+	blocks := fastCDCChunks(t, data)
+	average := len(data) / len(blocks)
+	if average < testAvg/2 || average > testAvg*2 {
+		t.Errorf("average block size %d is far from %d", average, testAvg)
+	}
+}
+
+func TestFastCDCInsertKeepsBoundaries(t *testing.T) {
+	data := randomData(2*1024*1024, 4)
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("a few inserted bytes")...), data[1000:]...)
+
+	original := make(map[string]bool)
+	for _, block := range fastCDCChunks(t, data) {
+		original[string(block)] = true
+	}
+	blocks := fastCDCChunks(t, inserted)
+
+	// only the blocks around the insert may change
+	changed := 0
+	for _, block := range blocks {
+		if !original[string(block)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d blocks changed after inserting near the start", changed, len(blocks))
+	}
+}
+
+func TestFastCDCInvalidSizes(t *testing.T) {
+	for _, sizes := range [][3]int{{0, 8, 16}, {8, 8, 16}, {8, 16, 16}, {1, 4, 8}} {
+		if _, err := NewFastCDC(bytes.NewReader(nil), sizes[0], sizes[1], sizes[2]); err == nil {
+			t.Errorf("NewFastCDC accepted %v", sizes)
+		}
+	}
+}
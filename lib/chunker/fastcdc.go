@@ -0,0 +1,133 @@
+package chunker
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// gear maps every byte to a pseudo random value. It has to stay the same forever,
+// otherwise blocks cut by different versions won't deduplicate.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	state := uint64(0x6261636b75702d74)
+	for i := range gear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type fastCDC struct {
+	r             io.Reader
+	min, avg, max int
+	maskS, maskL  uint64
+
+	buffer     []byte
+	start, end int
+	eof        bool
+}
+
+// NewFastCDC returns a content defined Chunker using normalized FastCDC.
+// Blocks are at least min and at most max bytes long and avg bytes on average.
+func NewFastCDC(r io.Reader, min, avg, max int) (Chunker, error) {
+	if min <= 0 || min >= avg || avg >= max {
+		return nil, fmt.Errorf("chunk sizes must satisfy 0 < min < avg < max: %d/%d/%d", min, avg, max)
+	}
+
+	b := bits.Len(uint(avg)) - 1
+	if b < 4 || b > 60 {
+		return nil, fmt.Errorf("average chunk size out of range: %d", avg)
+	}
+
+	// the small mask is harder to match and used below avg, the large one above avg,
+	// which pulls the block sizes towards avg. The masks use the upper bits of the
+	// fingerprint as they depend on the last 64 bytes instead of only the last few.
+	return &fastCDC{
+		r:     r,
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: ^uint64(0) << uint(64-(b+2)),
+		maskL: ^uint64(0) << uint(64-(b-2)),
+	}, nil
+}
+
+// fill reads until max bytes are buffered or the stream ends. The buffer grows up to max as needed.
+func (c *fastCDC) fill() error {
+	if c.eof || c.end-c.start >= c.max {
+		return nil
+	}
+
+	copy(c.buffer, c.buffer[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < c.max {
+		if c.end == len(c.buffer) {
+			grown := make([]byte, min(max(2*len(c.buffer), initialBufferSize), c.max))
+			copy(grown, c.buffer[:c.end])
+			c.buffer = grown
+		}
+		n, err := io.ReadFull(c.r, c.buffer[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func (c *fastCDC) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		c.buffer = nil
+		return nil, io.EOF
+	}
+
+	length := c.cut(c.buffer[c.start:c.end])
+	block := make([]byte, length)
+	copy(block, c.buffer[c.start:c.start+length])
+	c.start += length
+	return block, nil
+}
@@ -0,0 +1,62 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+type fixed struct {
+	r    io.Reader
+	size int
+
+	// buffer is reused for every block and grows up to size as needed
+	buffer []byte
+	eof    bool
+}
+
+// NewFixed returns a Chunker cutting r into blocks of exactly size bytes, except for the last one
+func NewFixed(r io.Reader, size int) (Chunker, error) {
+	if size <= 0 {
+		return nil, errors.New("blocksize must be positive")
+	}
+	return &fixed{r: r, size: size}, nil
+}
+
+func (c *fixed) Next() ([]byte, error) {
+	if c.eof {
+		return nil, io.EOF
+	}
+	if c.buffer == nil {
+		c.buffer = make([]byte, min(c.size, initialBufferSize))
+	}
+
+	n := 0
+	for {
+		read, err := io.ReadFull(c.r, c.buffer[n:])
+		n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == c.size {
+			break
+		}
+		grown := make([]byte, min(2*len(c.buffer), c.size))
+		copy(grown, c.buffer[:n])
+		c.buffer = grown
+	}
+	if c.eof {
+		// the buffer isn't needed anymore
+		defer func() { c.buffer = nil }()
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	block := make([]byte, n)
+	copy(block, c.buffer[:n])
+	return block, nil
+}
@@ -0,0 +1,124 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	None = ""
+	Zstd = "zstd"
+	LZ4  = "lz4"
+	Gzip = "gzip"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+}
+
+// Valid reports whether algorithm is a known compression algorithm
+func Valid(algorithm string) bool {
+	switch algorithm {
+	case None, Zstd, LZ4, Gzip:
+		return true
+	}
+	return false
+}
+
+// Compress compresses data with algorithm and returns the result together with
+// the algorithm that was actually applied. Data that doesn't get smaller is
+// returned as is with None as algorithm.
+func Compress(data []byte, algorithm string) ([]byte, string, error) {
+	var compressed []byte
+
+	switch algorithm {
+	case None:
+		return data, None, nil
+	case Zstd:
+		initZstd()
+		if zstdErr != nil {
+			return nil, None, zstdErr
+		}
+		compressed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+	case LZ4:
+		var compressor lz4.Compressor
+		buffer := make([]byte, lz4.CompressBlockBound(len(data)))
+		n, err := compressor.CompressBlock(data, buffer)
+		if err != nil {
+			return nil, None, err
+		}
+		if n == 0 {
+			return data, None, nil
+		}
+		compressed = buffer[:n]
+	case Gzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, None, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, None, err
+		}
+		compressed = buffer.Bytes()
+	default:
+		return nil, None, fmt.Errorf("unknown compression '%s'", algorithm)
+	}
+
+	if len(compressed) >= len(data) {
+		return data, None, nil
+	}
+	return compressed, algorithm, nil
+}
+
+// Decompress reverses Compress, size is the length of the uncompressed data
+func Decompress(data []byte, algorithm string, size int) ([]byte, error) {
+	switch algorithm {
+	case None:
+		return data, nil
+	case Zstd:
+		initZstd()
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	case LZ4:
+		buffer := make([]byte, size)
+		n, err := lz4.UncompressBlock(data, buffer)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, errors.New("lz4: unexpected decompressed size")
+		}
+		return buffer, nil
+	case Gzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", algorithm)
+}
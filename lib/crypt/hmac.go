@@ -0,0 +1,19 @@
+package aes256
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+)
+
+// NewKeyedHasher returns an HMAC-SHA256 using key, used to identify data without revealing its plain hash
+func NewKeyedHasher(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+// KeyedHash returns the HMAC-SHA256 of data under key
+func KeyedHash(key []byte, data []byte) []byte {
+	hasher := NewKeyedHasher(key)
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,67 @@
+package aes256
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KDFParams describe how the master key is derived from the passphrase
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time"`
+	Memory    uint32 `json:"memory"`
+	Threads   uint8  `json:"threads"`
+}
+
+// NewKDFParams returns Argon2id parameters with a fresh random salt
+func NewKDFParams() (*KDFParams, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return &KDFParams{
+		Algorithm: "argon2id",
+		Salt:      salt,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}, nil
+}
+
+// DeriveKey derives a 32 byte master key from passphrase
+func DeriveKey(passphrase []byte, params *KDFParams) ([]byte, error) {
+	if params.Algorithm != "argon2id" {
+		return nil, fmt.Errorf("unsupported kdf '%s'", params.Algorithm)
+	}
+	return argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, 32), nil
+}
+
+// WrapKey encrypts a key with the master key, the random nonce is prepended to the result
+func WrapKey(key []byte, masterKey []byte) ([]byte, error) {
+	nonce, err := GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := Encrypt(key, masterKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, wrapped...), nil
+}
+
+// UnwrapKey reverses WrapKey
+func UnwrapKey(wrapped []byte, masterKey []byte) ([]byte, error) {
+	if len(wrapped) < 12 {
+		return nil, errors.New("wrapped key too short")
+	}
+	return Decrypt(wrapped[12:], masterKey, wrapped[:12])
+}
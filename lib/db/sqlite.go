@@ -21,8 +21,38 @@ func RunStatement(db *sql.DB, sql string) sql.Result {
 	return result
 }
 
+// addColumn adds a column to an existing table unless it's already there
+func addColumn(db *sql.DB, table string, column string, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			log.Error(err)
+			return
+		}
+		if name == column {
+			return
+		}
+	}
+	rows.Close()
+
+	RunStatement(db, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	log.Debugf("Added column %s to %s table", column, table)
+}
+
 func InitDB(dbpath string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", dbpath)
+	// a single connection serialises concurrent users instead of failing with "database is locked"
+	// and makes the pragmas below apply to every statement
+	db.SetMaxOpenConns(1)
 	RunStatement(db, "PRAGMA foreign_keys = ON")
 	log.Debug("Enabling foreign keys")
 
@@ -36,6 +66,9 @@ func InitDB(dbpath string) (*sql.DB, error) {
 			"iv BLOB"+
 			")")
 	log.Debug("Created block table")
+	addColumn(db, "blocks", "compression", "TEXT DEFAULT ''")
+	addColumn(db, "blocks", "format", "INTEGER DEFAULT 0")
+	addColumn(db, "blocks", "hashtype", "TEXT DEFAULT 'sha256'")
 
 	RunStatement(db,
 		"CREATE TABLE IF NOT EXISTS fsobjects ("+
@@ -49,6 +82,17 @@ func InitDB(dbpath string) (*sql.DB, error) {
 			"hash BLOB"+
 			")")
 	log.Debug("Created fsobjects table")
+	addColumn(db, "fsobjects", "size", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "mtime", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "ctime", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "inode", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "type", "TEXT DEFAULT 'file'")
+	addColumn(db, "fsobjects", "rdev", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "atime", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "dev", "INTEGER DEFAULT 0")
+	addColumn(db, "fsobjects", "nlink", "INTEGER DEFAULT 1")
+	addColumn(db, "fsobjects", "uname", "TEXT DEFAULT ''")
+	addColumn(db, "fsobjects", "gname", "TEXT DEFAULT ''")
 
 	RunStatement(db,
 		"CREATE TABLE IF NOT EXISTS fileblocks ("+
@@ -60,6 +104,24 @@ func InitDB(dbpath string) (*sql.DB, error) {
 			")")
 	log.Debug("Created fsobject<>block table")
 
+	RunStatement(db,
+		"CREATE TABLE IF NOT EXISTS xattrs ("+
+			"fsobjectid INTEGER, "+
+			"name TEXT, "+
+			"value BLOB, "+
+			"FOREIGN KEY(fsobjectid) REFERENCES fsobjects(id)"+
+			")")
+	log.Debug("Created xattrs table")
+
+	RunStatement(db,
+		"CREATE TABLE IF NOT EXISTS holes ("+
+			"fsobjectid INTEGER, "+
+			"offset INTEGER, "+
+			"length INTEGER, "+
+			"FOREIGN KEY(fsobjectid) REFERENCES fsobjects(id)"+
+			")")
+	log.Debug("Created holes table")
+
 	RunStatement(db,
 		"CREATE TABLE IF NOT EXISTS backups ("+
 			"id INTEGER PRIMARY KEY AUTOINCREMENT, "+
@@ -70,6 +132,13 @@ func InitDB(dbpath string) (*sql.DB, error) {
 			"expires INTEGER"+
 			")")
 	log.Debug("Created backups table")
+	addColumn(db, "backups", "chunker", "TEXT DEFAULT 'fixed'")
+	addColumn(db, "backups", "chunkmin", "INTEGER DEFAULT 0")
+	addColumn(db, "backups", "chunkavg", "INTEGER DEFAULT 0")
+	addColumn(db, "backups", "chunkmax", "INTEGER DEFAULT 0")
+	addColumn(db, "backups", "manifest", "TEXT DEFAULT ''")
+	// backups used to be created with a placeholder expiration, 0 means they never expire
+	RunStatement(db, "UPDATE backups SET expires=0 WHERE expires=999999999")
 
 	RunStatement(db,
 		"CREATE TABLE IF NOT EXISTS backupobjects ("+
@@ -80,55 +149,181 @@ func InitDB(dbpath string) (*sql.DB, error) {
 			")")
 	log.Debug("Created backups<>fsobjetcs table")
 
+	RunStatement(db,
+		"CREATE TABLE IF NOT EXISTS metadata ("+
+			"key TEXT PRIMARY KEY, "+
+			"value BLOB"+
+			")")
+	log.Debug("Created metadata table")
+
 	return db, err
 }
 
-func AddBlockToIndex(db *sql.DB, block *model.BlockMeta) {
-	_, err := db.Exec("INSERT INTO blocks (hash, name, size, secret, iv) VALUES(?, ?, ?, ?, ?)", block.Hash, block.Name, block.Size, block.Secret, block.IV)
+func AddBlockToIndex(db *sql.DB, block *model.BlockMeta) (int64, error) {
+	result, err := db.Exec("INSERT INTO blocks (hash, name, size, secret, iv, compression, format, hashtype) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		block.Hash, block.Name, block.Size, block.Secret, block.IV, block.Compression, block.Format, block.HashType)
 	if err != nil {
 		log.Error(err)
+		return 0, err
 	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	block.ID = int(id)
 	log.Debugf("Added block to index: %x", block.Hash)
+	return id, nil
 }
 
-func GetBlockMeta(db *sql.DB, hash []byte) *model.BlockMeta {
-	rows, err := db.Query(fmt.Sprintf("SELECT * FROM blocks WHERE hash=x'%x'", hash))
+const blockColumns = "b.id, b.hash, b.name, b.size, b.secret, b.iv, b.compression, b.format, b.hashtype"
+
+func scanBlock(row scanner) (*model.BlockMeta, error) {
+	bm := &model.BlockMeta{}
+	err := row.Scan(&bm.ID, &bm.Hash, &bm.Name, &bm.Size, &bm.Secret, &bm.IV, &bm.Compression, &bm.Format, &bm.HashType)
+	if err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+func UpdateBlock(db *sql.DB, block *model.BlockMeta) error {
+	_, err := db.Exec("UPDATE blocks SET hash=?, name=?, size=?, secret=?, iv=?, compression=?, format=?, hashtype=? WHERE id=?",
+		block.Hash, block.Name, block.Size, block.Secret, block.IV, block.Compression, block.Format, block.HashType, block.ID)
 	if err != nil {
 		log.Error(err)
 	}
-	var bm model.BlockMeta
-	for rows.Next() {
-		rows.Scan(bm.ID, bm.Hash, bm.Name, bm.Size, bm.Secret, bm.IV)
-		//fmt.Printf("%d | %x | %x | %d | %x | %x\n", id, rhash, name, size, secret, iv)
-		rows.Close()
-		return &bm
+	return err
+}
+
+// ReplaceBlock points all files using block oldID to block newID and removes oldID from the index
+func ReplaceBlock(db *sql.DB, oldID int, newID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE fileblocks SET blockid=? WHERE blockid=?", newID, oldID)
+	if err != nil {
+		log.Error(err)
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM blocks WHERE id=?", oldID)
+	if err != nil {
+		log.Error(err)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func GetBlockMeta(db *sql.DB, hash []byte) *model.BlockMeta {
+	row := db.QueryRow("SELECT "+blockColumns+" FROM blocks b WHERE b.hash=? LIMIT 1", hash)
+
+	bm, err := scanBlock(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(err)
+		}
+		return nil
 	}
-	return nil
+	return bm
 }
 
-func AddFileToIndex(db *sql.DB, file *model.FSObject) {
-	_, err := db.Exec("INSERT INTO fsobjects (name, path, filemode, uid, gid, target, hash) VALUES(?, ?, ?, ?, ?, ?, ?)",
-		file.Name, file.Path, file.FileMode, file.User, file.Group, "", file.Hash)
+func AddFileToIndex(db *sql.DB, file *model.FSObject) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO fsobjects (name, path, filemode, uid, gid, target, hash, size, mtime, ctime, inode, type, rdev, atime, dev, nlink, uname, gname) "+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		file.Name, file.Path, file.FileMode, file.User, file.Group, file.Target, file.Hash, file.Size, file.ModTime, file.ChangeTime, int64(file.Inode),
+		file.Type, int64(file.Device), file.AccessTime, int64(file.DeviceID), int64(file.Links), file.UserName, file.GroupName)
 	if err != nil {
 		log.Error(err)
+		tx.Rollback()
+		return 0, err
 	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Error(err)
+		tx.Rollback()
+		return 0, err
+	}
+
+	for index, block := range file.Blocks {
+		_, err = tx.Exec("INSERT INTO fileblocks (ordernumber, fsobjectid, blockid) VALUES(?, ?, ?)", index, id, block.ID)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	for name, value := range file.Xattrs {
+		_, err = tx.Exec("INSERT INTO xattrs (fsobjectid, name, value) VALUES(?, ?, ?)", id, name, value)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	for _, hole := range file.Holes {
+		_, err = tx.Exec("INSERT INTO holes (fsobjectid, offset, length) VALUES(?, ?, ?)", id, hole.Offset, hole.Length)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	file.ID = int(id)
 	log.Debugf("Added file to index: %x", file.Hash)
+	return id, nil
+}
+
+const fsobjectColumns = "f.id, f.name, f.path, f.filemode, f.uid, f.gid, f.target, f.hash, f.size, f.mtime, f.ctime, f.inode, f.type, f.rdev, f.atime, f.dev, f.nlink, f.uname, f.gname"
+
+func scanFSObject(row scanner) (*model.FSObject, error) {
+	obj := &model.FSObject{}
+	var inode, device, deviceID, links int64
+	err := row.Scan(&obj.ID, &obj.Name, &obj.Path, &obj.FileMode, &obj.User, &obj.Group, &obj.Target, &obj.Hash,
+		&obj.Size, &obj.ModTime, &obj.ChangeTime, &inode, &obj.Type, &device, &obj.AccessTime, &deviceID, &links, &obj.UserName, &obj.GroupName)
+	if err != nil {
+		return nil, err
+	}
+	obj.Inode = uint64(inode)
+	obj.Device = uint64(device)
+	obj.DeviceID = uint64(deviceID)
+	obj.Links = uint64(links)
+	return obj, nil
 }
 
 func GetFSObj(db *sql.DB, name string, path string) []*model.FSObject {
-	rows, err := db.Query(fmt.Sprintf("SELECT * FROM fsobjects WHERE name='%s' AND path='%s'", name, path))
+	rows, err := db.Query("SELECT "+fsobjectColumns+" FROM fsobjects f WHERE f.name=? AND f.path=? ORDER BY f.id DESC", name, path)
 	if err != nil {
 		log.Error(err)
 		return nil
 	}
 
-	var obj *model.FSObject
-	var objects []*model.FSObject
-	objects = make([]*model.FSObject, 0)
-
+	objects := make([]*model.FSObject, 0)
 	for rows.Next() {
-		obj = &model.FSObject{}
-		err := rows.Scan(&obj.ID, &obj.Name, &obj.Path, &obj.FileMode, &obj.User, &obj.Group, &obj.Target, &obj.Hash)
+		obj, err := scanFSObject(rows)
 		if err != nil {
 			log.Error(err)
 		} else {
@@ -136,14 +331,379 @@ func GetFSObj(db *sql.DB, name string, path string) []*model.FSObject {
 		}
 	}
 	rows.Close()
+
+	loadXattrs(db, objects)
+	loadHoles(db, objects)
 	return objects
 }
 
-func AddBackupToIndex(db *sql.DB, backup *model.Backup) {
-	_, err := db.Exec("INSERT INTO backups (name, description, blocksize, created, expires) VALUES(?, ?, ?, ?, ?)",
-		backup.Name, backup.Description, backup.Blocksize, backup.Timestamp, backup.Expiration)
+// loadXattrs fills in the extended attributes of objects
+func loadXattrs(db *sql.DB, objects []*model.FSObject) {
+	for _, obj := range objects {
+		rows, err := db.Query("SELECT name, value FROM xattrs WHERE fsobjectid=?", obj.ID)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for rows.Next() {
+			var name string
+			var value []byte
+			if err := rows.Scan(&name, &value); err != nil {
+				log.Error(err)
+				continue
+			}
+			if obj.Xattrs == nil {
+				obj.Xattrs = make(map[string][]byte)
+			}
+			obj.Xattrs[name] = value
+		}
+		rows.Close()
+	}
+}
+
+// loadHoles fills in the holes of sparse files
+func loadHoles(db *sql.DB, objects []*model.FSObject) {
+	for _, obj := range objects {
+		rows, err := db.Query("SELECT offset, length FROM holes WHERE fsobjectid=? ORDER BY offset", obj.ID)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for rows.Next() {
+			var hole model.Hole
+			if err := rows.Scan(&hole.Offset, &hole.Length); err != nil {
+				log.Error(err)
+				continue
+			}
+			obj.Holes = append(obj.Holes, hole)
+		}
+		rows.Close()
+	}
+}
+
+func AddBackupToIndex(db *sql.DB, backup *model.Backup) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO backups (name, description, blocksize, created, expires, chunker, chunkmin, chunkavg, chunkmax, manifest) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		backup.Name, backup.Description, backup.Blocksize, backup.Timestamp, backup.Expiration,
+		backup.Chunker, backup.ChunkMin, backup.ChunkAvg, backup.ChunkMax, backup.Manifest)
+	if err != nil {
+		log.Error(err)
+		tx.Rollback()
+		return 0, err
+	}
+	id, err := result.LastInsertId()
 	if err != nil {
 		log.Error(err)
+		tx.Rollback()
+		return 0, err
 	}
+
+	for _, obj := range backup.Objects {
+		_, err = tx.Exec("INSERT INTO backupobjects (backupid, fsobjectid) VALUES(?, ?)", id, obj.ID)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	backup.ID = int(id)
 	log.Debugf("Added backup to index: '%s'", backup.Name)
+	return id, nil
+}
+
+const backupColumns = "id, name, description, blocksize, created, expires, chunker, chunkmin, chunkavg, chunkmax, manifest"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBackup(row scanner) (*model.Backup, error) {
+	backup := &model.Backup{}
+	err := row.Scan(&backup.ID, &backup.Name, &backup.Description, &backup.Blocksize, &backup.Timestamp, &backup.Expiration,
+		&backup.Chunker, &backup.ChunkMin, &backup.ChunkAvg, &backup.ChunkMax, &backup.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+func GetBackup(db *sql.DB, name string) *model.Backup {
+	row := db.QueryRow("SELECT "+backupColumns+" FROM backups WHERE name=? ORDER BY id DESC LIMIT 1", name)
+
+	backup, err := scanBackup(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(err)
+		}
+		return nil
+	}
+	return backup
+}
+
+// GetBackupByID returns the backup with the ID shown by list, nil if there's none
+func GetBackupByID(db *sql.DB, id int) *model.Backup {
+	row := db.QueryRow("SELECT "+backupColumns+" FROM backups WHERE id=?", id)
+
+	backup, err := scanBackup(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(err)
+		}
+		return nil
+	}
+	return backup
+}
+
+// SetBackupManifest records the name of the manifest object of a backup
+func SetBackupManifest(db *sql.DB, backupID int, manifest string) error {
+	_, err := db.Exec("UPDATE backups SET manifest=? WHERE id=?", manifest, backupID)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func GetBackupObjects(db *sql.DB, backupID int) []*model.FSObject {
+	rows, err := db.Query("SELECT "+fsobjectColumns+" "+
+		"FROM fsobjects f JOIN backupobjects bo ON bo.fsobjectid = f.id WHERE bo.backupid=? ORDER BY bo.rowid", backupID)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	objects := make([]*model.FSObject, 0)
+	for rows.Next() {
+		obj, err := scanFSObject(rows)
+		if err != nil {
+			log.Error(err)
+		} else {
+			objects = append(objects, obj)
+		}
+	}
+	rows.Close()
+
+	loadXattrs(db, objects)
+	loadHoles(db, objects)
+	return objects
+}
+
+func GetFileBlocks(db *sql.DB, fsobjectID int) []*model.BlockMeta {
+	rows, err := db.Query("SELECT "+blockColumns+" "+
+		"FROM blocks b JOIN fileblocks fb ON fb.blockid = b.id WHERE fb.fsobjectid=? ORDER BY fb.ordernumber", fsobjectID)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	blocks := make([]*model.BlockMeta, 0)
+	for rows.Next() {
+		bm, err := scanBlock(rows)
+		if err != nil {
+			log.Error(err)
+		} else {
+			blocks = append(blocks, bm)
+		}
+	}
+	return blocks
+}
+
+func GetBackups(db *sql.DB) []*model.Backup {
+	rows, err := db.Query("SELECT " + backupColumns + " FROM backups ORDER BY id")
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	backups := make([]*model.Backup, 0)
+	for rows.Next() {
+		backup, err := scanBackup(rows)
+		if err != nil {
+			log.Error(err)
+		} else {
+			backups = append(backups, backup)
+		}
+	}
+	return backups
+}
+
+func GetBackupStats(db *sql.DB, backupID int) (files int, size int64) {
+	row := db.QueryRow("SELECT COUNT(*) FROM backupobjects WHERE backupid=?", backupID)
+	if err := row.Scan(&files); err != nil {
+		log.Error(err)
+	}
+
+	// the logical size including holes, objects indexed before sizes were recorded count their blocks
+	row = db.QueryRow("SELECT COALESCE(SUM(CASE WHEN f.size > 0 THEN f.size ELSE "+
+		"(SELECT COALESCE(SUM(b.size), 0) FROM fileblocks fb JOIN blocks b ON b.id = fb.blockid WHERE fb.fsobjectid = f.id) END), 0) "+
+		"FROM backupobjects bo JOIN fsobjects f ON f.id = bo.fsobjectid WHERE bo.backupid=?", backupID)
+	if err := row.Scan(&size); err != nil {
+		log.Error(err)
+	}
+	return
+}
+
+func GetBlocks(db *sql.DB) []*model.BlockMeta {
+	rows, err := db.Query("SELECT " + blockColumns + " FROM blocks b ORDER BY b.id")
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	blocks := make([]*model.BlockMeta, 0)
+	for rows.Next() {
+		bm, err := scanBlock(rows)
+		if err != nil {
+			log.Error(err)
+		} else {
+			blocks = append(blocks, bm)
+		}
+	}
+	return blocks
+}
+
+func GetMetadata(db *sql.DB, key string) ([]byte, error) {
+	var value []byte
+	err := db.QueryRow("SELECT value FROM metadata WHERE key=?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return value, nil
+}
+
+func SetMetadata(db *sql.DB, key string, value []byte) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES(?, ?)", key, value)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+// SetKeyMaterial stores metadata entries and the secrets of the given blocks in one transaction,
+// so key changes never leave the index half converted
+func SetKeyMaterial(db *sql.DB, metadata map[string][]byte, blocks []*model.BlockMeta) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	for key, value := range metadata {
+		_, err = tx.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES(?, ?)", key, value)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, block := range blocks {
+		_, err = tx.Exec("UPDATE blocks SET secret=? WHERE id=?", block.Secret, block.ID)
+		if err != nil {
+			log.Error(err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+// RemoveBackups deletes the given backups and then all files and blocks no other backup references.
+// The removed blocks are returned so their objects can be deleted from the block store.
+// With dryRun nothing is changed, the result is what would have been removed.
+func RemoveBackups(db *sql.DB, backupIDs []int, dryRun bool) (files int, blocks []*model.BlockMeta, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	defer func() {
+		if err != nil || dryRun {
+			tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	for _, id := range backupIDs {
+		if _, err = tx.Exec("DELETE FROM backupobjects WHERE backupid=?", id); err != nil {
+			log.Error(err)
+			return 0, nil, err
+		}
+		if _, err = tx.Exec("DELETE FROM backups WHERE id=?", id); err != nil {
+			log.Error(err)
+			return 0, nil, err
+		}
+	}
+
+	unreferencedFiles := "SELECT id FROM fsobjects WHERE id NOT IN (SELECT fsobjectid FROM backupobjects)"
+	if err = tx.QueryRow("SELECT COUNT(*) FROM (" + unreferencedFiles + ")").Scan(&files); err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM xattrs WHERE fsobjectid IN (" + unreferencedFiles + ")"); err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM holes WHERE fsobjectid IN (" + unreferencedFiles + ")"); err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM fileblocks WHERE fsobjectid IN (" + unreferencedFiles + ")"); err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM fsobjects WHERE id IN (" + unreferencedFiles + ")"); err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+
+	rows, err := tx.Query("SELECT " + blockColumns + " FROM blocks b WHERE b.id NOT IN (SELECT blockid FROM fileblocks) ORDER BY b.id")
+	if err != nil {
+		log.Error(err)
+		return 0, nil, err
+	}
+	blocks = make([]*model.BlockMeta, 0)
+	for rows.Next() {
+		bm, scanErr := scanBlock(rows)
+		if scanErr != nil {
+			log.Error(scanErr)
+			rows.Close()
+			return 0, nil, scanErr
+		}
+		blocks = append(blocks, bm)
+	}
+	rows.Close()
+
+	for _, block := range blocks {
+		if _, err = tx.Exec("DELETE FROM blocks WHERE id=?", block.ID); err != nil {
+			log.Error(err)
+			return 0, nil, err
+		}
+	}
+	return files, blocks, nil
 }
@@ -0,0 +1,139 @@
+package exclude
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pattern is a single gitignore style pattern
+type Pattern struct {
+	// base is the slash separated directory the pattern is relative to
+	base     string
+	parts    []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ParsePattern parses a line in gitignore syntax relative to the directory base.
+// ok is false for blank lines and comments.
+func ParsePattern(line string, base string) (pattern Pattern, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false
+	}
+
+	pattern.base = filepath.ToSlash(filepath.Clean(base))
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a slash anywhere but at the end anchors the pattern to base
+	pattern.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return pattern, false
+	}
+
+	pattern.parts = strings.Split(line, "/")
+	return pattern, true
+}
+
+// ReadPatterns reads a file of gitignore style patterns relative to base
+func ReadPatterns(filename string, base string) ([]Pattern, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePatterns(f, base)
+}
+
+func parsePatterns(r io.Reader, base string) ([]Pattern, error) {
+	patterns := make([]Pattern, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if pattern, ok := ParsePattern(scanner.Text(), base); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// matches reports whether the pattern applies to the slash separated absolute path p
+func (pattern *Pattern) matches(p string, isDir bool) bool {
+	if pattern.dirOnly && !isDir {
+		return false
+	}
+
+	rel := strings.TrimPrefix(p, pattern.base)
+	if pattern.base != "/" {
+		if len(rel) == len(p) || !strings.HasPrefix(rel, "/") {
+			return false
+		}
+	}
+	rel = strings.TrimPrefix(rel, "/")
+	if rel == "" {
+		return false
+	}
+
+	components := strings.Split(rel, "/")
+	if !pattern.anchored {
+		ok, _ := path.Match(pattern.parts[0], components[len(components)-1])
+		return ok
+	}
+	return matchParts(pattern.parts, components)
+}
+
+// matchParts matches path components against pattern components, ** matches any number of components
+func matchParts(parts []string, components []string) bool {
+	for len(parts) > 0 {
+		if parts[0] == "**" {
+			if len(parts) == 1 {
+				return true
+			}
+			for skip := 0; skip <= len(components); skip++ {
+				if matchParts(parts[1:], components[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(parts[0], components[0]); !ok {
+			return false
+		}
+		parts, components = parts[1:], components[1:]
+	}
+	return len(components) == 0
+}
+
+// Excluded reports whether the last of patterns matching path excludes it
+func Excluded(patterns []Pattern, p string, isDir bool) bool {
+	p = filepath.ToSlash(p)
+	excluded := false
+	for i := range patterns {
+		if patterns[i].matches(p, isDir) {
+			excluded = !patterns[i].negate
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,115 @@
+package exclude
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchParts(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"**/b", "b", true},
+		{"**/b", "a/x/b", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/x/y/c", true},
+		{"a/**/c", "a/x/y/d", false},
+		{"*.log", "x.log", true},
+		{"*.log", "x.txt", false},
+	}
+	for _, test := range tests {
+		got := matchParts(strings.Split(test.pattern, "/"), strings.Split(test.path, "/"))
+		if got != test.want {
+			t.Errorf("matchParts(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := ParsePattern(line, "/src"); ok {
+			t.Errorf("ParsePattern(%q) should be skipped", line)
+		}
+	}
+
+	pattern, ok := ParsePattern(`\#file`, "/src")
+	if !ok || pattern.parts[0] != "#file" || pattern.negate {
+		t.Errorf("escaped pattern parsed as %+v", pattern)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"unanchored matches any depth", []string{"*.log"}, "/src/a/b/x.log", false, true},
+		{"unanchored matches directories", []string{"build"}, "/src/a/build", true, true},
+		{"anchored with leading slash", []string{"/build"}, "/src/build", true, true},
+		{"anchored with leading slash not below", []string{"/build"}, "/src/a/build", true, false},
+		{"anchored with inner slash", []string{"a/build"}, "/src/a/build", true, true},
+		{"anchored with inner slash not below", []string{"a/build"}, "/src/x/a/build", true, false},
+		{"double star prefix", []string{"**/tmp"}, "/src/a/b/tmp", true, true},
+		{"double star middle", []string{"a/**/x.o"}, "/src/a/b/c/x.o", false, true},
+		{"dir only skips files", []string{"cache/"}, "/src/cache", false, false},
+		{"dir only matches dirs", []string{"cache/"}, "/src/cache", true, true},
+		{"outside base", []string{"*.log"}, "/other/x.log", false, false},
+		{"base itself", []string{"*"}, "/src", true, false},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "/src/keep.log", false, false},
+		{"last pattern wins", []string{"!keep.log", "*.log"}, "/src/keep.log", false, true},
+		{"negation of other file", []string{"*.log", "!keep.log"}, "/src/drop.log", false, true},
+		{"no patterns", nil, "/src/x", false, false},
+	}
+	for _, test := range tests {
+		patterns := make([]Pattern, 0)
+		for _, line := range test.patterns {
+			if pattern, ok := ParsePattern(line, "/src"); ok {
+				patterns = append(patterns, pattern)
+			}
+		}
+		if got := Excluded(patterns, test.path, test.isDir); got != test.want {
+			t.Errorf("%s: Excluded(%v, %q) = %v, want %v", test.name, test.patterns, test.path, got, test.want)
+		}
+	}
+}
+
+func TestExcludedMergesIgnoreFileAndCommandLine(t *testing.T) {
+	// patterns from ignore files come first, the command line ones can override them
+	ignored, err := parsePatterns(strings.NewReader("# build output\n*.o\n!main.o\n\nsub/tmp/\n"), "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, _ := ParsePattern("main.o", "/src")
+	include, _ := ParsePattern("!sub/tmp", "/src")
+	withCLI := append(append([]Pattern{}, ignored...), cli)
+	withInclude := append(append([]Pattern{}, ignored...), include)
+
+	tests := []struct {
+		patterns []Pattern
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{ignored, "/src/x.o", false, true},
+		{ignored, "/src/main.o", false, false},
+		{ignored, "/src/sub/tmp", true, true},
+		{withCLI, "/src/main.o", false, true},
+		{withInclude, "/src/sub/tmp", true, false},
+	}
+	for i, test := range tests {
+		if got := Excluded(test.patterns, test.path, test.isDir); got != test.want {
+			t.Errorf("case %d: Excluded(%q) = %v, want %v", i, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package exclude
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// IgnoreFile holds patterns applying to the directory it's in and everything below
+	IgnoreFile = ".backupignore"
+	// CacheDirTag marks cache directories, see https://bford.info/cachedir/
+	CacheDirTag = "CACHEDIR.TAG"
+
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// Filter decides which paths a backup skips
+type Filter struct {
+	// Patterns are applied after the ones from ignore files
+	Patterns []Pattern
+	// ExcludeCaches skips directories with a valid CACHEDIR.TAG
+	ExcludeCaches bool
+	// ExcludeIfPresent skips directories containing one of these files
+	ExcludeIfPresent []string
+}
+
+// Walk returns root and all paths below it the filter doesn't exclude, parent directories first.
+// Excluded directories aren't descended into, unreadable ones are skipped with a warning.
+func Walk(root string, filter *Filter) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+	if filter.skipDir(root) {
+		log.Debugf("Excluding %s", root)
+		return []string{}, nil
+	}
+
+	files := []string{root}
+	filter.walk(root, nil, &files)
+	return files, nil
+}
+
+func (filter *Filter) walk(dir string, inherited []Pattern, files *[]string) {
+	patterns := inherited
+	ignored, err := ReadPatterns(filepath.Join(dir, IgnoreFile), dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn(err)
+	}
+	if len(ignored) > 0 {
+		patterns = append(append(make([]Pattern, 0, len(inherited)+len(ignored)), inherited...), ignored...)
+	}
+	all := append(append(make([]Pattern, 0, len(patterns)+len(filter.Patterns)), patterns...), filter.Patterns...)
+
+	f, err := os.Open(dir)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if Excluded(all, p, entry.IsDir()) || (entry.IsDir() && filter.skipDir(p)) {
+			log.Debugf("Excluding %s", p)
+			continue
+		}
+		*files = append(*files, p)
+		if entry.IsDir() {
+			filter.walk(p, patterns, files)
+		}
+	}
+}
+
+// skipDir reports whether dir contains one of the marker files excluding it
+func (filter *Filter) skipDir(dir string) bool {
+	for _, name := range filter.ExcludeIfPresent {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return filter.ExcludeCaches && isCacheDir(dir)
+}
+
+func isCacheDir(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, CacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	signature := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(f, signature); err != nil {
+		return false
+	}
+	return bytes.Equal(signature, []byte(cacheDirSignature))
+}
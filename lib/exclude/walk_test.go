@@ -0,0 +1,96 @@
+package exclude
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, IgnoreFile), "*.log\n")
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "a.log"), "a")
+	writeFile(t, filepath.Join(root, "sub", IgnoreFile), "!keep.log\nsecret\n")
+	writeFile(t, filepath.Join(root, "sub", "keep.log"), "k")
+	writeFile(t, filepath.Join(root, "sub", "drop.log"), "d")
+	writeFile(t, filepath.Join(root, "sub", "secret"), "s")
+	writeFile(t, filepath.Join(root, "secret"), "s")
+	writeFile(t, filepath.Join(root, "cache", CacheDirTag), cacheDirSignature+"\n")
+	writeFile(t, filepath.Join(root, "cache", "data"), "c")
+	writeFile(t, filepath.Join(root, "fakecache", CacheDirTag), "not a cache\n")
+	writeFile(t, filepath.Join(root, "fakecache", "data"), "c")
+	writeFile(t, filepath.Join(root, "marked", ".nobackup"), "")
+	writeFile(t, filepath.Join(root, "marked", "data"), "m")
+	writeFile(t, filepath.Join(root, "build", "out.bin"), "b")
+
+	cli, _ := ParsePattern("build/", root)
+	filter := &Filter{
+		Patterns:         []Pattern{cli},
+		ExcludeCaches:    true,
+		ExcludeIfPresent: []string{".nobackup"},
+	}
+	files, err := Walk(root, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(files))
+	for _, file := range files {
+		got = append(got, strings.TrimPrefix(strings.TrimPrefix(file, root), "/"))
+	}
+	want := []string{
+		"",
+		IgnoreFile,
+		"a.txt",
+		"fakecache",
+		"fakecache/" + CacheDirTag,
+		"fakecache/data",
+		"secret",
+		"sub",
+		"sub/" + IgnoreFile,
+		"sub/keep.log",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk returned\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestWalkExcludedRoot(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".nobackup"), "")
+	writeFile(t, filepath.Join(root, "data"), "d")
+
+	files, err := Walk(root, &Filter{ExcludeIfPresent: []string{".nobackup"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Walk returned %q for an excluded root", files)
+	}
+}
+
+func TestWalkSingleFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	writeFile(t, file, "f")
+
+	files, err := Walk(file, &Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{file}) {
+		t.Errorf("Walk returned %q", files)
+	}
+}
@@ -0,0 +1,153 @@
+package fsmeta
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+	capability = "security.capability"
+)
+
+// Options select which metadata Apply restores besides owner and mode
+type Options struct {
+	Times        bool
+	Xattrs       bool
+	ACLs         bool
+	Capabilities bool
+	// Owners maps the recorded owners, the numeric ids are used if it's nil
+	Owners *Owners
+}
+
+// ReadXattrs returns the extended attributes of path without following symlinks.
+// ACLs and capabilities are extended attributes as well.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, size)
+	size, err = unix.Llistxattr(path, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buffer[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, string(name))
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// Mode returns the permission bits of obj including setuid, setgid and sticky
+func Mode(obj *model.FSObject) os.FileMode {
+	return obj.FileMode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// Apply sets owner, mode and the selected metadata of obj on path. The owner is set first as it clears
+// setuid bits and capabilities, the times last. Metadata the filesystem or user can't set is skipped with a warning.
+func Apply(path string, obj *model.FSObject, options Options) error {
+	uid, gid := obj.User, obj.Group
+	if options.Owners != nil {
+		uid, gid = options.Owners.Resolve(obj)
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		log.Warn(err)
+	}
+
+	if obj.Type != model.TypeSymlink {
+		if err := os.Chmod(path, Mode(obj)); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(obj.Xattrs))
+	for name := range obj.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !options.wants(name) {
+			continue
+		}
+		err := unix.Lsetxattr(path, name, obj.Xattrs[name], 0)
+		if err == unix.ENOTSUP || err == unix.EPERM || err == unix.EACCES {
+			log.Warnf("Can't set %s on %s: %s (%s)", name, path, err, skipFlag(name))
+		} else if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	if options.Times && obj.ModTime != 0 {
+		atime := obj.AccessTime
+		if atime == 0 {
+			atime = obj.ModTime
+		}
+		times := []unix.Timespec{unix.NsecToTimespec(atime), unix.NsecToTimespec(obj.ModTime)}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (options *Options) wants(name string) bool {
+	switch {
+	case name == aclAccess || name == aclDefault:
+		return options.ACLs
+	case name == capability:
+		return options.Capabilities
+	}
+	return options.Xattrs
+}
+
+func skipFlag(name string) string {
+	switch {
+	case name == aclAccess || name == aclDefault:
+		return "skip with --no-acls"
+	case name == capability:
+		return "skip with --no-capabilities"
+	case strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "trusted."):
+		return "needs root, skip with --no-xattrs"
+	}
+	return "skip with --no-xattrs"
+}
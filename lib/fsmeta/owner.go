@@ -0,0 +1,154 @@
+package fsmeta
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways of picking the owner of restored files
+const (
+	// OwnerByName uses the local account with the recorded name, the numeric id if there is none
+	OwnerByName = "name"
+	// OwnerByID uses the recorded numeric ids as they are
+	OwnerByID = "id"
+)
+
+// Names looks up user and group names, caching the results
+type Names struct {
+	users  map[int]string
+	groups map[int]string
+}
+
+// NewNames returns an empty Names cache
+func NewNames() *Names {
+	return &Names{users: make(map[int]string), groups: make(map[int]string)}
+}
+
+// User returns the name of uid or an empty string if it has none
+func (n *Names) User(uid int) string {
+	name, ok := n.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		n.users[uid] = name
+	}
+	return name
+}
+
+// Group returns the name of gid or an empty string if it has none
+func (n *Names) Group(gid int) string {
+	name, ok := n.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			name = g.Name
+		}
+		n.groups[gid] = name
+	}
+	return name
+}
+
+// Owners maps the recorded owner of objects to the local one
+type Owners struct {
+	By string
+	// Users and Groups map a recorded name or id to a local name or id
+	Users  map[string]string
+	Groups map[string]string
+
+	uids   map[string]int
+	gids   map[string]int
+	warned map[string]bool
+}
+
+// NewOwners returns an Owners mapping by name or id with explicit mappings out of "old:new" pairs
+func NewOwners(by string, users []string, groups []string) (*Owners, error) {
+	if by != OwnerByName && by != OwnerByID {
+		return nil, fmt.Errorf("unknown owner mapping '%s', use %s or %s", by, OwnerByName, OwnerByID)
+	}
+	owners := &Owners{By: by, uids: make(map[string]int), gids: make(map[string]int), warned: make(map[string]bool)}
+	var err error
+	if owners.Users, err = parseMapping(users); err != nil {
+		return nil, err
+	}
+	if owners.Groups, err = parseMapping(groups); err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+func parseMapping(pairs []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid mapping '%s', expected old:new", pair)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+// Resolve returns the local uid and gid for obj
+func (o *Owners) Resolve(obj *model.FSObject) (uid int, gid int) {
+	uid = o.resolve("user", obj.User, obj.UserName, o.Users, o.uids, lookupUser)
+	gid = o.resolve("group", obj.Group, obj.GroupName, o.Groups, o.gids, lookupGroup)
+	return uid, gid
+}
+
+// resolve maps a recorded id and name, falling back to the recorded id if the local account is missing
+func (o *Owners) resolve(kind string, id int, name string, mapping map[string]string, cache map[string]int, lookup func(string) (int, error)) int {
+	key := strconv.Itoa(id) + ":" + name
+	if local, ok := cache[key]; ok {
+		return local
+	}
+
+	local := id
+	target, mapped := mapping[name]
+	if !mapped {
+		target, mapped = mapping[strconv.Itoa(id)]
+	}
+	if !mapped && o.By == OwnerByName && name != "" {
+		target, mapped = name, true
+	}
+	if mapped {
+		if resolved, err := lookup(target); err == nil {
+			local = resolved
+		} else if !o.warned[kind+target] {
+			log.Warnf("No local %s '%s', keeping id %d", kind, target, id)
+			o.warned[kind+target] = true
+		}
+	}
+
+	cache[key] = local
+	return local
+}
+
+// lookupUser returns the uid of a user name or numeric id
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of a group name or numeric id
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -4,32 +4,97 @@ import (
 	"os"
 )
 
+// TypeOf returns the FSObject type for a file mode
+func TypeOf(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDir != 0:
+		return TypeDir
+	case mode&os.ModeSymlink != 0:
+		return TypeSymlink
+	case mode&os.ModeCharDevice != 0:
+		return TypeCharDevice
+	case mode&os.ModeDevice != 0:
+		return TypeBlockDevice
+	case mode&os.ModeNamedPipe != 0:
+		return TypeFIFO
+	case mode&os.ModeSocket != 0:
+		return TypeSocket
+	}
+	return TypeFile
+}
+
 type Backup struct {
+	ID          int
 	Blocksize   int
 	Timestamp   int
 	Objects     []*FSObject
 	Name        string
 	Description string
 	Expiration  int
+	Chunker     string
+	ChunkMin    int
+	ChunkAvg    int
+	ChunkMax    int
+	Manifest    string
 }
 
+// Types of FSObjects
+const (
+	TypeFile        = "file"
+	TypeDir         = "dir"
+	TypeSymlink     = "symlink"
+	TypeBlockDevice = "blockdev"
+	TypeCharDevice  = "chardev"
+	TypeFIFO        = "fifo"
+	TypeSocket      = "socket"
+)
+
 type FSObject struct {
 	ID       int
+	Type     string
 	Name     string
 	Path     string
 	FileMode os.FileMode
 	User     int
 	Group    int
-	Target   string
-	Hash     []byte
-	Blocks   []*BlockMeta
+	// UserName and GroupName of the owner when the backup was made, empty if unknown
+	UserName  string
+	GroupName string
+	// Target of a symlink
+	Target string
+	// Device number of block and character devices
+	Device uint64
+	Hash   []byte
+	Blocks []*BlockMeta
+	// Size, ModTime and ChangeTime (in ns) and Inode tell whether a file changed since it was read
+	Size       int64
+	ModTime    int64
+	ChangeTime int64
+	Inode      uint64
+	AccessTime int64
+	// DeviceID of the filesystem holding the file, together with Inode it identifies hard links
+	DeviceID uint64
+	Links    uint64
+	// Xattrs hold extended attributes including ACLs and capabilities
+	Xattrs map[string][]byte
+	// Holes of a sparse file, Blocks only hold the data in between
+	Holes []Hole
+}
+
+// Hole is a range of a sparse file without data, reading it returns zeros
+type Hole struct {
+	Offset int64
+	Length int64
 }
 
 type BlockMeta struct {
-	ID     int
-	Hash   []byte
-	Secret []byte
-	IV     []byte
-	Name   []byte
-	Size   int
+	ID          int
+	Hash        []byte
+	Secret      []byte
+	IV          []byte
+	Name        []byte
+	Size        int
+	Compression string
+	Format      int
+	HashType    string
 }
@@ -0,0 +1,60 @@
+package mount
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+)
+
+// BlockCache keeps the most recently read blocks decrypted, up to a total size in bytes
+type BlockCache struct {
+	repo    *repository.Repository
+	maxSize int
+
+	mu     sync.Mutex
+	size   int
+	order  *list.List
+	blocks map[int]*list.Element
+}
+
+type cachedBlock struct {
+	id   int
+	data []byte
+}
+
+// NewBlockCache returns an empty cache for blocks of repo
+func NewBlockCache(repo *repository.Repository, maxSize int) *BlockCache {
+	return &BlockCache{repo: repo, maxSize: maxSize, order: list.New(), blocks: make(map[int]*list.Element)}
+}
+
+// Get returns the contents of block, reading it from the repository if it's not cached
+func (c *BlockCache) Get(block *model.BlockMeta) ([]byte, error) {
+	c.mu.Lock()
+	if element, ok := c.blocks[block.ID]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cachedBlock).data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := c.repo.ReadBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[block.ID]; !ok {
+		c.blocks[block.ID] = c.order.PushFront(&cachedBlock{id: block.ID, data: data})
+		c.size += len(data)
+	}
+	// the newest block stays even if it's bigger than the whole cache
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		oldest := c.order.Remove(c.order.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.id)
+		c.size -= len(oldest.data)
+	}
+	return data, nil
+}
@@ -0,0 +1,372 @@
+package mount
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/sparse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backups never change once written, the kernel may cache entries and attributes for long
+const cacheTimeout = time.Hour
+
+// latestName links to the newest backup of a name
+const latestName = "latest"
+
+// Options configure a mount
+type Options struct {
+	// CacheSize is the number of bytes of decrypted blocks kept in memory
+	CacheSize  int
+	AllowOther bool
+	Debug      bool
+}
+
+// Mount exposes every backup read only as /<backup name>/<backup ID>/<original path> below dir,
+// /<backup name>/latest links to the newest one.
+// The contents of a backup are read from the index when it's first accessed, file contents block by block when read.
+func Mount(dir string, repo *repository.Repository, options Options) (*fuse.Server, error) {
+	timeout := cacheTimeout
+	root := &node{repo: repo, cache: NewBlockCache(repo, options.CacheSize)}
+	root.load = root.loadBackups
+
+	server, err := fs.Mount(dir, root, &fs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName:      "backup-tool",
+			Name:        "backup",
+			Options:     []string{"ro"},
+			AllowOther:  options.AllowOther,
+			DirectMount: true,
+			Debug:       options.Debug,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return server, nil
+}
+
+// node is a backed up object. Directories leading to the backed up paths and the
+// directories of the backup names and IDs have no object.
+type node struct {
+	fs.Inode
+
+	repo  *repository.Repository
+	cache *BlockCache
+	obj   *model.FSObject
+	// created is the time of the backup, shown for directories without an object
+	created time.Time
+
+	// load adds the children of the root and backup directories on first access
+	loadOnce sync.Once
+	load     func(ctx context.Context)
+
+	// content of a file, set up when it's first opened
+	contentOnce sync.Once
+	content     io.ReaderAt
+}
+
+var (
+	_ fs.NodeLookuper    = (*node)(nil)
+	_ fs.NodeOpendirer   = (*node)(nil)
+	_ fs.NodeGetattrer   = (*node)(nil)
+	_ fs.NodeOpener      = (*node)(nil)
+	_ fs.NodeReader      = (*node)(nil)
+	_ fs.NodeReadlinker  = (*node)(nil)
+	_ fs.NodeGetxattrer  = (*node)(nil)
+	_ fs.NodeListxattrer = (*node)(nil)
+)
+
+func (n *node) loadChildren(ctx context.Context) {
+	if n.load != nil {
+		n.loadOnce.Do(func() { n.load(ctx) })
+	}
+}
+
+// loadBackups adds a directory for every backup name holding a directory per backup ID
+// and a latest link to the newest one
+func (n *node) loadBackups(ctx context.Context) {
+	names := make(map[string]*node)
+	latest := make(map[string]*model.Backup)
+	for _, backup := range sqlite.GetBackups(n.repo.DB) {
+		if backup.Name == "" || strings.Contains(backup.Name, "/") {
+			log.Warnf("Can't show backup '%s', the name isn't a valid file name", backup.Name)
+			continue
+		}
+		created := time.Unix(int64(backup.Timestamp), 0)
+
+		parent, ok := names[backup.Name]
+		if !ok {
+			parent = &node{repo: n.repo, cache: n.cache}
+			names[backup.Name] = parent
+			n.AddChild(backup.Name, n.NewPersistentInode(ctx, parent, fs.StableAttr{Mode: syscall.S_IFDIR}), false)
+		}
+		// backups are listed by ID, so the last one is the newest
+		parent.created = created
+		latest[backup.Name] = backup
+
+		backup := backup
+		dir := &node{repo: n.repo, cache: n.cache, created: created}
+		dir.load = func(ctx context.Context) {
+			dir.loadObjects(ctx, sqlite.GetBackupObjects(n.repo.DB, backup.ID))
+		}
+		parent.AddChild(strconv.Itoa(backup.ID), parent.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: syscall.S_IFDIR}), false)
+	}
+
+	for name, backup := range latest {
+		created := int64(backup.Timestamp) * int64(time.Second)
+		link := &node{repo: n.repo, cache: n.cache, obj: &model.FSObject{
+			Name:       latestName,
+			Type:       model.TypeSymlink,
+			FileMode:   os.ModeSymlink | 0777,
+			Target:     strconv.Itoa(backup.ID),
+			Links:      1,
+			AccessTime: created,
+			ModTime:    created,
+			ChangeTime: created,
+		}}
+		names[name].AddChild(latestName, names[name].NewPersistentInode(ctx, link, fs.StableAttr{Mode: syscall.S_IFLNK}), false)
+	}
+}
+
+// loadObjects adds the objects of a backup below their original paths
+func (n *node) loadObjects(ctx context.Context, objects []*model.FSObject) {
+	for _, obj := range objects {
+		parent := n.mkdirAll(ctx, obj.Path)
+		if filepath.Join(obj.Path, obj.Name) == "/" {
+			n.obj = obj
+			continue
+		}
+
+		if existing := parent.GetChild(obj.Name); existing != nil {
+			// a directory created on the way to an earlier object
+			if dir := existing.Operations().(*node); dir.obj == nil && obj.Type == model.TypeDir {
+				dir.obj = obj
+			}
+			continue
+		}
+		child := &node{repo: n.repo, cache: n.cache, obj: obj}
+		parent.AddChild(obj.Name, parent.NewPersistentInode(ctx, child, fs.StableAttr{Mode: fileType(obj)}), false)
+	}
+}
+
+// mkdirAll returns the node of path below n, adding directories without an object where needed
+func (n *node) mkdirAll(ctx context.Context, path string) *node {
+	dir := n
+	for _, name := range strings.Split(filepath.Clean(path), "/") {
+		if name == "" {
+			continue
+		}
+		child := dir.GetChild(name)
+		if child == nil {
+			child = dir.NewPersistentInode(ctx, &node{repo: n.repo, cache: n.cache, created: n.created}, fs.StableAttr{Mode: syscall.S_IFDIR})
+			dir.AddChild(name, child, false)
+		}
+		dir = child.Operations().(*node)
+	}
+	return dir
+}
+
+func fileType(obj *model.FSObject) uint32 {
+	switch obj.Type {
+	case model.TypeDir:
+		return syscall.S_IFDIR
+	case model.TypeSymlink:
+		return syscall.S_IFLNK
+	case model.TypeBlockDevice:
+		return syscall.S_IFBLK
+	case model.TypeCharDevice:
+		return syscall.S_IFCHR
+	case model.TypeFIFO:
+		return syscall.S_IFIFO
+	case model.TypeSocket:
+		return syscall.S_IFSOCK
+	}
+	return syscall.S_IFREG
+}
+
+// permissions returns the permission bits of obj including setuid, setgid and sticky as used by syscalls
+func permissions(obj *model.FSObject) uint32 {
+	mode := uint32(obj.FileMode.Perm())
+	if obj.FileMode&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if obj.FileMode&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if obj.FileMode&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.loadChildren(ctx)
+	child := n.GetChild(name)
+	if child == nil {
+		return nil, syscall.ENOENT
+	}
+	var attr fuse.AttrOut
+	child.Operations().(*node).Getattr(ctx, nil, &attr)
+	out.Attr = attr.Attr
+	return child, 0
+}
+
+func (n *node) Opendir(ctx context.Context) syscall.Errno {
+	n.loadChildren(ctx)
+	return 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if n.obj == nil {
+		out.Mode = 0555
+		out.Nlink = 2
+		out.SetTimes(&n.created, &n.created, &n.created)
+		return 0
+	}
+
+	out.Mode = permissions(n.obj)
+	out.Uid = uint32(n.obj.User)
+	out.Gid = uint32(n.obj.Group)
+	out.Nlink = uint32(n.obj.Links)
+	out.Rdev = uint32(n.obj.Device)
+	out.Size = uint64(n.obj.Size)
+	if n.obj.Type == model.TypeSymlink {
+		out.Size = uint64(len(n.obj.Target))
+	}
+	allocated := n.obj.Size
+	for _, hole := range n.obj.Holes {
+		allocated -= hole.Length
+	}
+	out.Blocks = uint64(allocated+511) / 512
+	out.Blksize = 4096
+
+	atime := time.Unix(0, n.obj.AccessTime)
+	mtime := time.Unix(0, n.obj.ModTime)
+	ctime := time.Unix(0, n.obj.ChangeTime)
+	out.SetTimes(&atime, &mtime, &ctime)
+	return 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	n.contentOnce.Do(func() {
+		var content io.ReaderAt = newBlockReader(n.cache, sqlite.GetFileBlocks(n.repo.DB, n.obj.ID))
+		if len(n.obj.Holes) > 0 {
+			content = sparse.NewReaderAt(content, n.obj.Size, n.obj.Holes)
+		}
+		n.content = content
+	})
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *node) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	read, err := n.content.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Errorf("Can't read %s: %s", filepath.Join(n.obj.Path, n.obj.Name), err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:read]), 0
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.obj == nil || n.obj.Type != model.TypeSymlink {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.obj.Target), 0
+}
+
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if n.obj == nil {
+		return 0, syscall.ENODATA
+	}
+	value, ok := n.obj.Xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if n.obj == nil {
+		return 0, 0
+	}
+	names := make([]string, 0, len(n.obj.Xattrs))
+	for name := range n.obj.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]byte, 0)
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+// blockReader reads the contents of a file out of its blocks
+type blockReader struct {
+	cache  *BlockCache
+	blocks []*model.BlockMeta
+	// offsets of the blocks within the file
+	offsets []int64
+}
+
+func newBlockReader(cache *BlockCache, blocks []*model.BlockMeta) *blockReader {
+	offsets := make([]int64, len(blocks))
+	offset := int64(0)
+	for i, block := range blocks {
+		offsets[i] = offset
+		offset += int64(block.Size)
+	}
+	return &blockReader{cache: cache, blocks: blocks, offsets: offsets}
+}
+
+func (r *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.offsets[i]+int64(r.blocks[i].Size) > off
+	})
+	for ; n < len(p) && i < len(r.blocks); i++ {
+		data, err := r.cache.Get(r.blocks[i])
+		if err != nil {
+			return n, err
+		}
+		start := off + int64(n) - r.offsets[i]
+		if start > int64(len(data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], data[start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
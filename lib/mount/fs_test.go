@@ -0,0 +1,327 @@
+package mount
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gentoomaniac/backup-tool/lib/compress"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/exclude"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/pipeline"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/sparse"
+
+	_ "github.com/gentoomaniac/backup-tool/lib/storage/local"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testBlocksize = 4096
+
+// testRepository holds a repository with one backup "n" of a small tree below src
+type testRepository struct {
+	repo   *repository.Repository
+	src    string
+	backup *model.Backup
+	files  map[string][]byte
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestRepository(t *testing.T) *testRepository {
+	t.Helper()
+	dir := t.TempDir()
+
+	repo, err := repository.Init(filepath.Join(dir, "backup.db"), &repository.Config{
+		Storage:     "file://" + filepath.Join(dir, "blocks"),
+		Chunker:     "fixed",
+		Blocksize:   testBlocksize,
+		Compression: compress.None,
+	}, func(bool) ([]byte, error) { return []byte("test"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	src := filepath.Join(dir, "src")
+	tr := &testRepository{repo: repo, src: src, files: make(map[string][]byte)}
+	tr.files["dir/file.txt"] = randomData(t, 3*testBlocksize+100)
+	tr.files["small"] = []byte("small file\n")
+	for name, data := range tr.files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/file.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a sparse file with data in two places and a hole at the end
+	sparseData := make([]byte, 64*testBlocksize)
+	copy(sparseData[8*testBlocksize:], randomData(t, 3*testBlocksize))
+	copy(sparseData[40*testBlocksize:], randomData(t, testBlocksize+10))
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(sparseData[8*testBlocksize:11*testBlocksize], 8*testBlocksize)
+	f.WriteAt(sparseData[40*testBlocksize:41*testBlocksize+10], 40*testBlocksize)
+	f.Truncate(int64(len(sparseData)))
+	f.Close()
+	tr.files["sparse"] = sparseData
+
+	tr.backup = &model.Backup{
+		Blocksize: testBlocksize,
+		Timestamp: int(time.Now().Unix()),
+		Objects:   make([]*model.FSObject, 0),
+		Name:      "n",
+		Chunker:   "fixed",
+	}
+	files, err := exclude.Walk(src, &exclude.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pipeline.New(repo, tr.backup, compress.None, 2, false).Run(files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sqlite.AddBackupToIndex(repo.DB, tr.backup); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func (tr *testRepository) object(t *testing.T, name string) *model.FSObject {
+	t.Helper()
+	for _, obj := range tr.backup.Objects {
+		if filepath.Join(obj.Path, obj.Name) == filepath.Join(tr.src, name) {
+			return obj
+		}
+	}
+	t.Fatalf("no object %s in the backup", name)
+	return nil
+}
+
+func TestSparseReadAt(t *testing.T) {
+	tr := newTestRepository(t)
+	obj := tr.object(t, "sparse")
+	if len(obj.Holes) == 0 {
+		t.Skip("the filesystem doesn't report holes")
+	}
+
+	cache := NewBlockCache(tr.repo, 1<<20)
+	content := sparse.NewReaderAt(newBlockReader(cache, sqlite.GetFileBlocks(tr.repo.DB, obj.ID)), obj.Size, obj.Holes)
+	want := tr.files["sparse"]
+
+	tests := []struct {
+		off    int64
+		length int
+	}{
+		{0, 100},                                // inside the leading hole
+		{8*testBlocksize - 10, 20},              // from a hole into data
+		{9*testBlocksize - 5, 10},               // across a block boundary
+		{11*testBlocksize - 5, 10},              // from data into a hole
+		{7 * testBlocksize, 35 * testBlocksize}, // across both data ranges
+		{41*testBlocksize + 5, 10},              // the end of the second data range
+		{int64(len(want)) - 10, 10},             // the trailing hole
+		{0, len(want)},                          // everything
+	}
+	for _, test := range tests {
+		buffer := make([]byte, test.length)
+		n, err := content.ReadAt(buffer, test.off)
+		if err != nil || n != test.length {
+			t.Errorf("ReadAt(%d, %d) returned %d, %v", test.off, test.length, n, err)
+			continue
+		}
+		if !bytes.Equal(buffer, want[test.off:test.off+int64(test.length)]) {
+			t.Errorf("ReadAt(%d, %d) returned wrong data", test.off, test.length)
+		}
+	}
+
+	buffer := make([]byte, 20)
+	n, err := content.ReadAt(buffer, int64(len(want))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("ReadAt past the end returned %d, %v", n, err)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	tr := newTestRepository(t)
+	blocks := sqlite.GetFileBlocks(tr.repo.DB, tr.object(t, "dir/file.txt").ID)
+	if len(blocks) != 4 {
+		t.Fatalf("file has %d blocks, want 4", len(blocks))
+	}
+
+	cache := NewBlockCache(tr.repo, 2*testBlocksize)
+	for _, block := range blocks[:2] {
+		if _, err := cache.Get(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// using the first block again makes the second the least recently used
+	if _, err := cache.Get(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	data, err := cache.Get(blocks[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tr.files["dir/file.txt"][2*testBlocksize:3*testBlocksize]) {
+		t.Error("cache returned wrong data")
+	}
+
+	if cache.size > cache.maxSize || cache.order.Len() != 2 {
+		t.Errorf("cache holds %d blocks with %d bytes, max %d", cache.order.Len(), cache.size, cache.maxSize)
+	}
+	for _, want := range []struct {
+		block  *model.BlockMeta
+		cached bool
+	}{{blocks[0], true}, {blocks[1], false}, {blocks[2], true}} {
+		if _, ok := cache.blocks[want.block.ID]; ok != want.cached {
+			t.Errorf("block %d cached: %v, want %v", want.block.ID, ok, want.cached)
+		}
+	}
+
+	// a block bigger than the whole cache is still kept until the next one comes along
+	small := NewBlockCache(tr.repo, 10)
+	if _, err := small.Get(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if small.order.Len() != 1 {
+		t.Errorf("cache holds %d blocks, want 1", small.order.Len())
+	}
+}
+
+func TestMount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("/dev/fuse not available")
+	}
+	tr := newTestRepository(t)
+
+	// a newer backup of the same name with one more file
+	if err := os.WriteFile(filepath.Join(tr.src, "added"), []byte("added\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newer := &model.Backup{Blocksize: testBlocksize, Timestamp: int(time.Now().Unix()), Name: "n", Chunker: "fixed"}
+	files, err := exclude.Walk(tr.src, &exclude.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pipeline.New(tr.repo, newer, compress.None, 1, false).Run(files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sqlite.AddBackupToIndex(tr.repo.DB, newer); err != nil {
+		t.Fatal(err)
+	}
+
+	mountpoint := t.TempDir()
+	server, err := Mount(mountpoint, tr.repo, Options{CacheSize: 2 * testBlocksize})
+	if err != nil {
+		t.Skipf("can't mount: %s", err)
+	}
+	defer server.Unmount()
+
+	entries, err := os.ReadDir(mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "n" || !entries[0].IsDir() {
+		t.Fatalf("mountpoint holds %v, want the backup n", entries)
+	}
+
+	backupDir, newerDir := strconv.Itoa(tr.backup.ID), strconv.Itoa(newer.ID)
+	entries, err = os.ReadDir(filepath.Join(mountpoint, "n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != backupDir+" "+newerDir+" latest" {
+		t.Fatalf("n holds %q, want both backups and latest", names)
+	}
+	if target, err := os.Readlink(filepath.Join(mountpoint, "n", "latest")); err != nil || target != newerDir {
+		t.Errorf("latest links to %q, %v, want %s", target, err, newerDir)
+	}
+	if data, err := os.ReadFile(filepath.Join(mountpoint, "n", "latest", tr.src, "added")); err != nil || string(data) != "added\n" {
+		t.Errorf("reading the file of the newer backup returned %q, %v", data, err)
+	}
+
+	root := filepath.Join(mountpoint, "n", backupDir, tr.src)
+	entries, err = os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = names[:0]
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "dir link small sparse" {
+		t.Errorf("backup root holds %q", names)
+	}
+
+	if _, err := os.Lstat(filepath.Join(root, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Lstat of a missing file returned %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(root, "dir", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0640 || info.Size() != int64(len(tr.files["dir/file.txt"])) {
+		t.Errorf("file.txt has mode %s and size %d", info.Mode(), info.Size())
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "link"))
+	if err != nil || target != "dir/file.txt" {
+		t.Errorf("Readlink returned %q, %v", target, err)
+	}
+
+	for name, want := range tr.files {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("can't read %s: %s", name, err)
+		} else if !bytes.Equal(data, want) {
+			t.Errorf("%s differs from the backed up file", name)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buffer := make([]byte, 3*testBlocksize)
+	off := int64(9*testBlocksize - 100)
+	if _, err := f.ReadAt(buffer, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer, tr.files["sparse"][off:off+int64(len(buffer))]) {
+		t.Error("reading across blocks and a hole returned wrong data")
+	}
+
+	_, err = os.OpenFile(filepath.Join(root, "small"), os.O_WRONLY, 0)
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.EROFS {
+		t.Errorf("opening for writing returned %v, want EROFS", err)
+	}
+}
@@ -0,0 +1,498 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/gentoomaniac/backup-tool/lib/chunker"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/fsmeta"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+	"github.com/gentoomaniac/backup-tool/lib/sparse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pipeline backs up files in stages connected by channels:
+//
+//	walker -> chunker -> hash/encrypt workers -> upload workers -> index writer
+//
+// The walker stats files and skips unchanged ones, the chunker reads files one after
+// another and hashes their content, the workers identify, compress, encrypt and store
+// blocks and a single index writer adds blocks and files to the index.
+type Pipeline struct {
+	repo        *repository.Repository
+	backup      *model.Backup
+	compression string
+	workers     int
+	force       bool
+	// names caches the owner names looked up by the walker
+	names *fsmeta.Names
+
+	// tokens bounds the number of blocks held in memory
+	tokens chan struct{}
+
+	pendingMu sync.Mutex
+	pending   map[string]*pendingBlock
+
+	errMu sync.Mutex
+	err   error
+	// skipped counts the files that vanished or couldn't be read
+	skipped int
+}
+
+// pendingBlock is a block seen during this run. done is closed once it's in the index or failed.
+type pendingBlock struct {
+	meta *model.BlockMeta
+	data []byte
+	done chan struct{}
+	err  error
+}
+
+type chunk struct {
+	data []byte
+	ref  chan *pendingBlock
+}
+
+// fileJob follows a file through the pipeline
+type fileJob struct {
+	path      string
+	reader    io.Reader
+	obj       *model.FSObject
+	existing  []*model.FSObject
+	unchanged bool
+	// linkOf is the job of an earlier hard link to the same file
+	linkOf *fileJob
+	// skipped files couldn't be read and aren't added to the backup
+	skipped bool
+	refs    []chan *pendingBlock
+	blocks  []*pendingBlock
+}
+
+// New returns a pipeline adding files to backup with the given number of workers per stage
+func New(repo *repository.Repository, backup *model.Backup, compression string, workers int, force bool) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pipeline{
+		repo:        repo,
+		backup:      backup,
+		compression: compression,
+		workers:     workers,
+		force:       force,
+		names:       fsmeta.NewNames(),
+		tokens:      make(chan struct{}, 2*workers),
+		pending:     make(map[string]*pendingBlock),
+	}
+}
+
+func (p *Pipeline) fail(err error) {
+	log.Error(err)
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// skip leaves out a file that can't be read instead of failing the whole backup
+func (p *Pipeline) skip(file string, err error) {
+	log.Warnf("Skipping %s: %s", file, err)
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	p.skipped++
+}
+
+// Skipped returns the number of files left out of the backup because they couldn't be read
+func (p *Pipeline) Skipped() int {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.skipped
+}
+
+func (p *Pipeline) failed() bool {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err != nil
+}
+
+// Run backs up files, directories and special files and appends them to the backup in the given order.
+// Files that vanish or can't be read are skipped, only errors of the index and block store fail the run.
+func (p *Pipeline) Run(files []string) error {
+	return p.run(func(jobs chan<- *fileJob) {
+		p.walk(files, jobs)
+	})
+}
+
+// RunReader backs up the contents of r as the file described by obj
+func (p *Pipeline) RunReader(obj *model.FSObject, r io.Reader) error {
+	return p.run(func(jobs chan<- *fileJob) {
+		defer close(jobs)
+		obj.Type = model.TypeFile
+		jobs <- &fileJob{path: filepath.Join(obj.Path, obj.Name), reader: r, obj: obj}
+	})
+}
+
+func (p *Pipeline) run(walk func(jobs chan<- *fileJob)) error {
+	jobs := make(chan *fileJob, p.workers)
+	chunked := make(chan *fileJob, p.workers)
+	chunks := make(chan *chunk, p.workers)
+	uploads := make(chan *pendingBlock, p.workers)
+	indexed := make(chan *pendingBlock, p.workers)
+
+	go walk(jobs)
+	go p.chunk(jobs, chunked, chunks)
+
+	var hashers sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			p.hash(chunks, uploads)
+		}()
+	}
+	go func() {
+		hashers.Wait()
+		close(uploads)
+	}()
+
+	var uploaders sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		uploaders.Add(1)
+		go func() {
+			defer uploaders.Done()
+			p.upload(uploads, indexed)
+		}()
+	}
+	go func() {
+		uploaders.Wait()
+		close(indexed)
+	}()
+
+	p.writeIndex(chunked, indexed)
+	return p.err
+}
+
+// walk stats the files and looks up their previous versions
+func (p *Pipeline) walk(files []string, jobs chan<- *fileJob) {
+	defer close(jobs)
+
+	links := make(map[[2]uint64]*fileJob)
+
+	for _, file := range files {
+		if p.failed() {
+			return
+		}
+		log.Debugf("Backing up file %s", file)
+
+		filestat, err := os.Lstat(file)
+		if err != nil {
+			p.skip(file, err)
+			continue
+		}
+
+		job := &fileJob{path: file, obj: &model.FSObject{}}
+		job.obj.Name = filepath.Base(file)
+		job.obj.Path, _ = filepath.Abs(filepath.Dir(file))
+		job.obj.Type = model.TypeOf(filestat.Mode())
+		if stat, ok := filestat.Sys().(*syscall.Stat_t); ok {
+			job.obj.User = int(stat.Uid)
+			job.obj.Group = int(stat.Gid)
+			job.obj.UserName = p.names.User(job.obj.User)
+			job.obj.GroupName = p.names.Group(job.obj.Group)
+			job.obj.ChangeTime = stat.Ctim.Nano()
+			job.obj.AccessTime = stat.Atim.Nano()
+			job.obj.Inode = stat.Ino
+			job.obj.DeviceID = uint64(stat.Dev)
+			job.obj.Links = uint64(stat.Nlink)
+			if job.obj.Type == model.TypeBlockDevice || job.obj.Type == model.TypeCharDevice {
+				job.obj.Device = stat.Rdev
+			}
+		}
+		job.obj.FileMode = filestat.Mode()
+		job.obj.ModTime = filestat.ModTime().UnixNano()
+		if job.obj.Type == model.TypeFile {
+			job.obj.Size = filestat.Size()
+		}
+		if job.obj.Type == model.TypeSymlink {
+			if job.obj.Target, err = os.Readlink(file); err != nil {
+				p.skip(file, err)
+				continue
+			}
+		}
+		if job.obj.Xattrs, err = fsmeta.ReadXattrs(file); err != nil {
+			log.Warnf("Can't read extended attributes of %s: %s", file, err)
+		}
+
+		if job.obj.Type == model.TypeFile && job.obj.Links > 1 {
+			key := [2]uint64{job.obj.DeviceID, job.obj.Inode}
+			job.linkOf = links[key]
+			if job.linkOf == nil {
+				links[key] = job
+			}
+		}
+
+		job.existing = sqlite.GetFSObj(p.repo.DB, job.obj.Name, job.obj.Path)
+		if !p.force {
+			if previous := repository.FindUnchanged(job.existing, job.obj); previous != nil {
+				previous.Blocks = sqlite.GetFileBlocks(p.repo.DB, previous.ID)
+				log.Debugf("File unchanged, reusing %d blocks", len(previous.Blocks))
+				if previous.UserName != job.obj.UserName || previous.GroupName != job.obj.GroupName {
+					// the account was renamed or the object predates owner names, index it again
+					renamed := *previous
+					renamed.ID = 0
+					renamed.UserName = job.obj.UserName
+					renamed.GroupName = job.obj.GroupName
+					previous = &renamed
+				}
+				job.obj = previous
+				job.unchanged = true
+			}
+		}
+		jobs <- job
+	}
+}
+
+// chunk reads the files one after another, splits them into chunks and hashes the whole file
+func (p *Pipeline) chunk(jobs <-chan *fileJob, chunked chan<- *fileJob, chunks chan<- *chunk) {
+	defer close(chunks)
+	defer close(chunked)
+
+	for job := range jobs {
+		// only regular files have contents, everything else is described by its metadata
+		if !job.unchanged && job.linkOf == nil && job.obj.Type == model.TypeFile && !p.failed() {
+			if err := p.chunkFile(job, chunks); err != nil {
+				p.fail(err)
+			}
+		}
+		chunked <- job
+	}
+}
+
+// chunkFile queues the chunks of a file. A file that can't be read is marked as skipped,
+// chunks queued before a read error are still stored but not referenced by the backup.
+func (p *Pipeline) chunkFile(job *fileJob, chunks chan<- *chunk) error {
+	r := job.reader
+	if r == nil {
+		f, err := os.Open(job.path)
+		if err != nil {
+			job.skipped = true
+			p.skip(job.path, err)
+			return nil
+		}
+		defer f.Close()
+		r = f
+
+		// only data is read from sparse files, the holes are recorded instead
+		if filestat, err := f.Stat(); err == nil {
+			if stat, ok := filestat.Sys().(*syscall.Stat_t); ok && stat.Blocks*512 < job.obj.Size {
+				holes, err := sparse.Holes(f, job.obj.Size)
+				if err != nil {
+					job.skipped = true
+					p.skip(job.path, err)
+					return nil
+				}
+				if len(holes) > 0 {
+					job.obj.Holes = holes
+					r = sparse.DataReader(f, job.obj.Size, holes)
+				}
+			}
+		}
+	}
+
+	splitter, err := chunker.New(r, p.backup)
+	if err != nil {
+		return err
+	}
+	filehasher := p.repo.NewFileHasher()
+	size := int64(0)
+	for {
+		p.tokens <- struct{}{}
+		data, err := splitter.Next()
+		if err != nil {
+			<-p.tokens
+			if err == io.EOF {
+				break
+			}
+			if job.reader == nil {
+				job.skipped = true
+				p.skip(job.path, err)
+				return nil
+			}
+			return err
+		}
+		filehasher.Write(data)
+		size += int64(len(data))
+
+		ref := make(chan *pendingBlock, 1)
+		job.refs = append(job.refs, ref)
+		chunks <- &chunk{data: data, ref: ref}
+	}
+
+	job.obj.Hash = filehasher.Sum(nil)
+	if job.reader != nil {
+		job.obj.Size = size
+	}
+	log.Debugf("File hash: %x", job.obj.Hash)
+	return nil
+}
+
+// claim returns the block stored under hash. isNew is set if the caller has to write it.
+func (p *Pipeline) claim(hash []byte) (block *pendingBlock, isNew bool) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	if block, ok := p.pending[string(hash)]; ok {
+		return block, false
+	}
+	block = &pendingBlock{done: make(chan struct{})}
+	p.pending[string(hash)] = block
+
+	if existing := sqlite.GetBlockMeta(p.repo.DB, hash); existing != nil {
+		block.meta = existing
+		close(block.done)
+		return block, false
+	}
+	return block, true
+}
+
+// hash identifies chunks and encrypts the ones not stored yet
+func (p *Pipeline) hash(chunks <-chan *chunk, uploads chan<- *pendingBlock) {
+	for c := range chunks {
+		meta, err := p.repo.NewBlock(c.data)
+		if err != nil {
+			p.fail(err)
+			block := &pendingBlock{err: err, done: make(chan struct{})}
+			close(block.done)
+			c.ref <- block
+			<-p.tokens
+			continue
+		}
+
+		block, isNew := p.claim(meta.Hash)
+		c.ref <- block
+		if !isNew {
+			<-p.tokens
+			continue
+		}
+
+		block.meta = meta
+		block.data, block.err = p.repo.SealBlock(meta, c.data, p.compression)
+		uploads <- block
+	}
+}
+
+// upload stores the encrypted blocks
+func (p *Pipeline) upload(uploads <-chan *pendingBlock, indexed chan<- *pendingBlock) {
+	for block := range uploads {
+		if block.err == nil {
+			block.err = p.repo.PutBlock(block.meta, block.data)
+		}
+		block.data = nil
+		<-p.tokens
+		indexed <- block
+	}
+}
+
+// writeIndex adds stored blocks to the index and then the files, in the order they were walked
+func (p *Pipeline) writeIndex(chunked <-chan *fileJob, indexed <-chan *pendingBlock) {
+	queue := make([]*fileJob, 0)
+	for chunked != nil || indexed != nil {
+		select {
+		case job, ok := <-chunked:
+			if !ok {
+				chunked = nil
+				continue
+			}
+			queue = append(queue, job)
+		case block, ok := <-indexed:
+			if !ok {
+				indexed = nil
+				continue
+			}
+			if block.err == nil {
+				_, block.err = sqlite.AddBlockToIndex(p.repo.DB, block.meta)
+			}
+			close(block.done)
+		}
+		queue = p.writeFiles(queue, false)
+	}
+	p.writeFiles(queue, true)
+}
+
+// writeFiles adds the files at the start of queue whose blocks are all indexed.
+// With wait it blocks until that's the case for every file.
+func (p *Pipeline) writeFiles(queue []*fileJob, wait bool) []*fileJob {
+	for len(queue) > 0 {
+		job := queue[0]
+		if !job.unchanged && !p.resolve(job, wait) {
+			return queue
+		}
+		queue = queue[1:]
+		if p.failed() || job.skipped || (job.linkOf != nil && job.linkOf.skipped) {
+			continue
+		}
+
+		if !job.unchanged {
+			if job.linkOf != nil {
+				// the earlier link is further up the queue and already written
+				job.obj.Hash = job.linkOf.obj.Hash
+				job.obj.Blocks = job.linkOf.obj.Blocks
+				job.obj.Holes = job.linkOf.obj.Holes
+			} else {
+				job.obj.Blocks = make([]*model.BlockMeta, 0, len(job.blocks))
+				for _, block := range job.blocks {
+					job.obj.Blocks = append(job.obj.Blocks, block.meta)
+				}
+			}
+			if existing := repository.FindFSObject(job.existing, job.obj); existing != nil {
+				job.obj.ID = existing.ID
+			}
+		}
+		if job.obj.ID == 0 {
+			if _, err := sqlite.AddFileToIndex(p.repo.DB, job.obj); err != nil {
+				p.fail(err)
+				continue
+			}
+		}
+		p.backup.Objects = append(p.backup.Objects, job.obj)
+	}
+	return queue
+}
+
+// resolve collects the blocks of a file and reports whether all of them are indexed
+func (p *Pipeline) resolve(job *fileJob, wait bool) bool {
+	for len(job.blocks) < len(job.refs) {
+		ref := job.refs[len(job.blocks)]
+		if wait {
+			job.blocks = append(job.blocks, <-ref)
+			continue
+		}
+		select {
+		case block := <-ref:
+			job.blocks = append(job.blocks, block)
+		default:
+			return false
+		}
+	}
+
+	for _, block := range job.blocks {
+		if wait {
+			<-block.done
+		} else {
+			select {
+			case <-block.done:
+			default:
+				return false
+			}
+		}
+		if block.err != nil {
+			p.fail(block.err)
+		}
+	}
+	return true
+}
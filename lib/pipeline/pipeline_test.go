@@ -0,0 +1,63 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gentoomaniac/backup-tool/lib/compress"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/repository"
+
+	_ "github.com/gentoomaniac/backup-tool/lib/storage/local"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestRepository(t *testing.T) *repository.Repository {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := repository.Init(filepath.Join(dir, "backup.db"), &repository.Config{
+		Storage:     "file://" + filepath.Join(dir, "blocks"),
+		Chunker:     "fixed",
+		Blocksize:   4096,
+		Compression: compress.None,
+	}, func(bool) ([]byte, error) { return []byte("test"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestRunSkipsUnreadableFiles(t *testing.T) {
+	repo := newTestRepository(t)
+	src := t.TempDir()
+	readable := filepath.Join(src, "readable")
+	if err := os.WriteFile(readable, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(src, "vanished"), readable}
+	want := 1
+	// a regular file that can be opened but not read
+	if f, err := os.Open("/proc/self/mem"); err == nil {
+		_, err = f.Read(make([]byte, 1))
+		f.Close()
+		if err != nil {
+			files = append(files, "/proc/self/mem")
+			want++
+		}
+	}
+
+	backup := &model.Backup{Blocksize: 4096, Timestamp: int(time.Now().Unix()), Name: "n", Chunker: "fixed"}
+	p := New(repo, backup, compress.None, 2, false)
+	if err := p.Run(files); err != nil {
+		t.Fatalf("Run failed on unreadable files: %s", err)
+	}
+	if p.Skipped() != want {
+		t.Errorf("skipped %d files, want %d", p.Skipped(), want)
+	}
+	if len(backup.Objects) != 1 || backup.Objects[0].Name != "readable" {
+		t.Errorf("backup holds %d objects, want only the readable file", len(backup.Objects))
+	}
+}
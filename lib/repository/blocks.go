@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"hash"
+
+	"github.com/gentoomaniac/backup-tool/lib/compress"
+	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BlockFormatRaw blocks hold only the ciphertext, the nonce is kept in the index
+	BlockFormatRaw = 0
+	// BlockFormatNoncePrefixed blocks start with their own random nonce followed by the ciphertext
+	BlockFormatNoncePrefixed = 1
+
+	nonceSize = 12
+
+	// HashTypeSHA256 blocks are identified by the plain hash of their content
+	HashTypeSHA256 = "sha256"
+	// HashTypeHMAC blocks are identified by a hash keyed with the repository id key,
+	// which is also the name they are stored under
+	HashTypeHMAC = "hmac-sha256"
+)
+
+// BlockHash returns the identifier of data as used by blocks of the given hash type
+func (r *Repository) BlockHash(hashType string, data []byte) []byte {
+	if hashType == HashTypeHMAC {
+		return aes256.KeyedHash(r.idKey, data)
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// NewFileHasher returns the hash used to identify file contents
+func (r *Repository) NewFileHasher() hash.Hash {
+	return aes256.NewKeyedHasher(r.idKey)
+}
+
+// NewBlock returns the metadata for a new block holding data, with a fresh secret
+func (r *Repository) NewBlock(data []byte) (*model.BlockMeta, error) {
+	secret, err := aes256.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := r.BlockHash(HashTypeHMAC, data)
+	return &model.BlockMeta{
+		Hash:     hash,
+		Name:     hash,
+		Secret:   secret,
+		Size:     len(data),
+		HashType: HashTypeHMAC,
+	}, nil
+}
+
+// NewBlockName returns a random object name for a block that can't be stored under its hash,
+// e.g. because an older copy still occupies that name
+func NewBlockName() ([]byte, error) {
+	name := make([]byte, 32)
+	if _, err := rand.Read(name); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return name, nil
+}
+
+// WriteBlock compresses, encrypts and stores data with a fresh nonce. The compression and nonce
+// actually used are recorded in block and block.Secret is replaced by its wrapped form as it is kept in the index.
+func (r *Repository) WriteBlock(block *model.BlockMeta, data []byte, compression string) error {
+	sealed, err := r.SealBlock(block, data, compression)
+	if err != nil {
+		return err
+	}
+	return r.PutBlock(block, sealed)
+}
+
+// SealBlock is the part of WriteBlock returning the block contents instead of storing them
+func (r *Repository) SealBlock(block *model.BlockMeta, data []byte, compression string) ([]byte, error) {
+	compressed, algorithm, err := compress.Compress(data, compression)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	block.Compression = algorithm
+
+	nonce, err := aes256.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	encryptedData, err := aes256.Encrypt(compressed, block.Secret, nonce)
+	if err != nil {
+		return nil, err
+	}
+	block.IV = nonce
+	block.Format = BlockFormatNoncePrefixed
+
+	wrappedSecret, err := aes256.WrapKey(block.Secret, r.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	block.Secret = wrappedSecret
+
+	return append(nonce, encryptedData...), nil
+}
+
+// PutBlock stores the contents of a block as returned by SealBlock
+func (r *Repository) PutBlock(block *model.BlockMeta, sealed []byte) error {
+	return r.Storage.Put(storage.BlockName(block), sealed)
+}
+
+// ReadBlock fetches, decrypts and decompresses a block
+func (r *Repository) ReadBlock(block *model.BlockMeta) ([]byte, error) {
+	encryptedData, err := r.Storage.Get(storage.BlockName(block))
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := aes256.UnwrapKey(block.Secret, r.masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := block.IV
+	if block.Format == BlockFormatNoncePrefixed {
+		if len(encryptedData) < nonceSize {
+			return nil, errors.New("block too short")
+		}
+		nonce, encryptedData = encryptedData[:nonceSize], encryptedData[nonceSize:]
+	}
+
+	compressed, err := aes256.Decrypt(encryptedData, secret, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := compress.Decompress(compressed, block.Compression, block.Size)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"bytes"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+// sameFile reports whether two objects carry the same file metadata
+func sameFile(a *model.FSObject, b *model.FSObject) bool {
+	return a.Type == b.Type && a.Size == b.Size && a.ModTime == b.ModTime && a.ChangeTime == b.ChangeTime && a.Inode == b.Inode && a.DeviceID == b.DeviceID && a.Links == b.Links &&
+		a.FileMode == b.FileMode && a.User == b.User && a.Group == b.Group && a.Target == b.Target && a.Device == b.Device
+}
+
+// sameHoles reports whether two objects have their data at the same offsets
+func sameHoles(a *model.FSObject, b *model.FSObject) bool {
+	if len(a.Holes) != len(b.Holes) {
+		return false
+	}
+	for i := range a.Holes {
+		if a.Holes[i] != b.Holes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FindUnchanged returns the object out of objects that was read from obj's file
+// when it was last modified, so its blocks can be reused without reading the file again
+func FindUnchanged(objects []*model.FSObject, obj *model.FSObject) *model.FSObject {
+	if obj.ChangeTime == 0 {
+		return nil
+	}
+	for _, candidate := range objects {
+		if sameFile(candidate, obj) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// FindFSObject returns the object out of objects with the same content and metadata as obj
+func FindFSObject(objects []*model.FSObject, obj *model.FSObject) *model.FSObject {
+	for _, candidate := range objects {
+		if bytes.Equal(candidate.Hash, obj.Hash) && sameFile(candidate, obj) && sameHoles(candidate, obj) &&
+			candidate.UserName == obj.UserName && candidate.GroupName == obj.GroupName {
+			return candidate
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+
+	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const keyCheckPlaintext = "backup-tool master key"
+
+// ErrWrongPassphrase is returned if the passphrase doesn't unlock the master key
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+func (r *Repository) kdfParams() (*aes256.KDFParams, error) {
+	encodedParams, err := sqlite.GetMetadata(r.DB, "kdf")
+	if err != nil {
+		return nil, err
+	}
+	if encodedParams == nil {
+		return nil, errors.New("index has no kdf parameters")
+	}
+
+	params := &aes256.KDFParams{}
+	if err = json.Unmarshal(encodedParams, params); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return params, nil
+}
+
+// createMasterKey derives a new master key and wraps all block secrets already in the index with it
+func (r *Repository) createMasterKey(passphrase []byte) error {
+	params, err := aes256.NewKDFParams()
+	if err != nil {
+		return err
+	}
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := aes256.DeriveKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+	keycheck, err := aes256.WrapKey([]byte(keyCheckPlaintext), masterKey)
+	if err != nil {
+		return err
+	}
+
+	blocks := sqlite.GetBlocks(r.DB)
+	for _, block := range blocks {
+		block.Secret, err = aes256.WrapKey(block.Secret, masterKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sqlite.SetKeyMaterial(r.DB, map[string][]byte{
+		"kdf":      encodedParams,
+		"keycheck": keycheck,
+	}, blocks)
+	if err != nil {
+		return err
+	}
+	log.Infof("Created master key, wrapped %d existing block secrets", len(blocks))
+
+	r.masterKey = masterKey
+	return nil
+}
+
+// createIDKey generates the repository secret used for keyed block identifiers
+func (r *Repository) createIDKey() error {
+	idKey, err := aes256.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	wrappedIDKey, err := aes256.WrapKey(idKey, r.masterKey)
+	if err != nil {
+		return err
+	}
+	if err = sqlite.SetMetadata(r.DB, "idkey", wrappedIDKey); err != nil {
+		return err
+	}
+	log.Info("Created block identifier key")
+
+	r.idKey = idKey
+	return nil
+}
+
+// loadKeys unlocks the master key and the block identifier key of the index, creating them on first use
+func (r *Repository) loadKeys(passphraseFunc PassphraseFunc) error {
+	encodedParams, err := sqlite.GetMetadata(r.DB, "kdf")
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := passphraseFunc(encodedParams == nil)
+	if err != nil {
+		return err
+	}
+
+	if encodedParams == nil {
+		if err = r.createMasterKey(passphrase); err != nil {
+			return err
+		}
+	} else {
+		params, err := r.kdfParams()
+		if err != nil {
+			return err
+		}
+		r.masterKey, err = aes256.DeriveKey(passphrase, params)
+		if err != nil {
+			return err
+		}
+
+		keycheck, err := sqlite.GetMetadata(r.DB, "keycheck")
+		if err != nil {
+			return err
+		}
+		if plaintext, err := aes256.UnwrapKey(keycheck, r.masterKey); err != nil || string(plaintext) != keyCheckPlaintext {
+			return ErrWrongPassphrase
+		}
+	}
+
+	wrappedIDKey, err := sqlite.GetMetadata(r.DB, "idkey")
+	if err != nil {
+		return err
+	}
+	if wrappedIDKey == nil {
+		return r.createIDKey()
+	}
+	r.idKey, err = aes256.UnwrapKey(wrappedIDKey, r.masterKey)
+	return err
+}
+
+// UnwrapSecret returns the plain secret of a block as kept wrapped in the index
+func (r *Repository) UnwrapSecret(wrapped []byte) ([]byte, error) {
+	return aes256.UnwrapKey(wrapped, r.masterKey)
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const manifestPrefix = "manifests/"
+
+// manifest is the encrypted copy of a backup with all its files and blocks kept in the block store,
+// so the index can be rebuilt if it's lost
+type manifest struct {
+	Version int           `json:"version"`
+	Backup  *model.Backup `json:"backup"`
+}
+
+// NewManifestName returns a random object name for the manifest of a new backup
+func NewManifestName() (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return manifestPrefix + hex.EncodeToString(id), nil
+}
+
+// loadBackupObjects fills in the files and blocks of a backup read from the index
+func (r *Repository) loadBackupObjects(backup *model.Backup) {
+	backup.Objects = sqlite.GetBackupObjects(r.DB, backup.ID)
+	for _, obj := range backup.Objects {
+		obj.Blocks = sqlite.GetFileBlocks(r.DB, obj.ID)
+	}
+}
+
+// WriteManifest stores the encrypted manifest of backup under backup.Manifest, backup.Objects has to be complete
+func (r *Repository) WriteManifest(backup *model.Backup) error {
+	if backup.Manifest == "" {
+		return errors.New("backup has no manifest name")
+	}
+
+	encodedManifest, err := json.Marshal(&manifest{Version: Version, Backup: backup})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	data, err := aes256.WrapKey(encodedManifest, r.masterKey)
+	if err != nil {
+		return err
+	}
+	return r.Storage.Put(backup.Manifest, data)
+}
+
+// SyncManifests writes the manifests of all backups in the index that don't have one in the block store yet.
+// With rewrite all manifests are written again, which is needed after blocks changed.
+func (r *Repository) SyncManifests(rewrite bool) error {
+	written := 0
+	for _, backup := range sqlite.GetBackups(r.DB) {
+		if backup.Manifest == "" {
+			name, err := NewManifestName()
+			if err != nil {
+				return err
+			}
+			if err = sqlite.SetBackupManifest(r.DB, backup.ID, name); err != nil {
+				return err
+			}
+			backup.Manifest = name
+		} else if !rewrite {
+			exists, err := r.Storage.Exists(backup.Manifest)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+		}
+
+		r.loadBackupObjects(backup)
+		if err := r.WriteManifest(backup); err != nil {
+			return err
+		}
+		written++
+	}
+	log.Debugf("Wrote %d backup manifests", written)
+	return nil
+}
+
+// readManifests returns the backups of all manifests in the block store, oldest first
+func (r *Repository) readManifests() ([]*model.Backup, error) {
+	names, err := r.Storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]*model.Backup, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, manifestPrefix) {
+			continue
+		}
+
+		data, err := r.Storage.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		encodedManifest, err := aes256.UnwrapKey(data, r.masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt manifest %s: %v", name, err)
+		}
+		m := &manifest{}
+		if err = json.Unmarshal(encodedManifest, m); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		m.Backup.Manifest = name
+		backups = append(backups, m.Backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Timestamp != backups[j].Timestamp {
+			return backups[i].Timestamp < backups[j].Timestamp
+		}
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, nil
+}
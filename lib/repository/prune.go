@@ -0,0 +1,63 @@
+package repository
+
+import (
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/model"
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneResult sums up what a removal of backups freed
+type PruneResult struct {
+	Backups int
+	Files   int
+	Blocks  int
+	// Bytes is the stored size of the removed blocks
+	Bytes int64
+}
+
+// RemoveBackups forgets the given backups, deletes their manifests and all blocks
+// no remaining backup references. With dryRun only the result is computed.
+func (r *Repository) RemoveBackups(backups []*model.Backup, dryRun bool) (*PruneResult, error) {
+	ids := make([]int, 0, len(backups))
+	for _, backup := range backups {
+		ids = append(ids, backup.ID)
+	}
+
+	files, blocks, err := sqlite.RemoveBackups(r.DB, ids, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	result := &PruneResult{Backups: len(backups), Files: files, Blocks: len(blocks)}
+
+	for _, block := range blocks {
+		size, err := r.Storage.Stat(storage.BlockName(block))
+		if err != nil && err != storage.ErrNotExist {
+			return nil, err
+		}
+		result.Bytes += size
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	// the index is committed first, a failure below only leaves unreferenced objects behind
+	for _, backup := range backups {
+		if backup.Manifest == "" {
+			continue
+		}
+		if err := r.Storage.Delete(backup.Manifest); err != nil && err != storage.ErrNotExist {
+			log.Warnf("Can't remove manifest %s: %s", backup.Manifest, err)
+		}
+	}
+	for _, block := range blocks {
+		name := storage.BlockName(block)
+		if err := r.Storage.Delete(name); err != nil && err != storage.ErrNotExist {
+			log.Warnf("Can't remove block %s: %s", name, err)
+		}
+	}
+	log.Infof("Removed %d backups, %d files and %d blocks", result.Backups, result.Files, result.Blocks)
+
+	return result, nil
+}
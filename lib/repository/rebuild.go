@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+
+	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebuild creates a new index at dbpath from the config object and the backup manifests
+// in the block store at blockpath. Only the passphrase is needed.
+func Rebuild(dbpath string, blockpath string, passphrase PassphraseFunc) (*Repository, error) {
+	database, err := sqlite.InitDB(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := loadConfig(database)
+	if err == nil && existing != nil {
+		err = fmt.Errorf("%s already belongs to repository %s", dbpath, existing.ID)
+	}
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	store, err := storage.Open(blockpath)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	r := &Repository{DB: database, Storage: store}
+
+	if err = r.restoreConfig(blockpath, passphrase); err == nil {
+		err = r.restoreBackups()
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// restoreConfig unlocks the config object in the block store and writes config and keys to the index
+func (r *Repository) restoreConfig(blockpath string, passphraseFunc PassphraseFunc) error {
+	object, err := getConfigObject(r.Storage)
+	if err == storage.ErrNotExist {
+		return fmt.Errorf("%s holds no repository", blockpath)
+	}
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := passphraseFunc(false)
+	if err != nil {
+		return err
+	}
+	r.masterKey, err = aes256.DeriveKey(passphrase, object.KDF)
+	if err != nil {
+		return err
+	}
+	r.Config, r.idKey, err = readConfigObject(object, r.masterKey)
+	if err != nil {
+		return err
+	}
+	r.Config.Storage = storage.Redact(blockpath)
+
+	encodedParams, err := json.Marshal(object.KDF)
+	if err != nil {
+		return err
+	}
+	keycheck, err := aes256.WrapKey([]byte(keyCheckPlaintext), r.masterKey)
+	if err != nil {
+		return err
+	}
+	wrappedIDKey, err := aes256.WrapKey(r.idKey, r.masterKey)
+	if err != nil {
+		return err
+	}
+	encodedConfig, err := json.Marshal(r.Config)
+	if err != nil {
+		return err
+	}
+
+	err = sqlite.SetKeyMaterial(r.DB, map[string][]byte{
+		"kdf":      encodedParams,
+		"keycheck": keycheck,
+		"idkey":    wrappedIDKey,
+		configName: encodedConfig,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored config of repository %s", r.Config.ID)
+	return nil
+}
+
+// restoreBackups adds the backups, files and blocks of all manifests to the index
+func (r *Repository) restoreBackups() error {
+	backups, err := r.readManifests()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		for _, obj := range backup.Objects {
+			for index, block := range obj.Blocks {
+				if existing := sqlite.GetBlockMeta(r.DB, block.Hash); existing != nil {
+					obj.Blocks[index] = existing
+				} else if _, err = sqlite.AddBlockToIndex(r.DB, block); err != nil {
+					return err
+				}
+			}
+
+			if existing := FindFSObject(sqlite.GetFSObj(r.DB, obj.Name, obj.Path), obj); existing != nil {
+				obj.ID = existing.ID
+			} else if _, err = sqlite.AddFileToIndex(r.DB, obj); err != nil {
+				return err
+			}
+		}
+
+		if _, err = sqlite.AddBackupToIndex(r.DB, backup); err != nil {
+			return err
+		}
+		log.Infof("Restored backup '%s' with %d files", backup.Name, len(backup.Objects))
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	aes256 "github.com/gentoomaniac/backup-tool/lib/crypt"
+	sqlite "github.com/gentoomaniac/backup-tool/lib/db"
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Version is the repository format version written by init
+	Version = 1
+	// Cipher used for blocks and wrapped keys
+	Cipher = "aes-256-gcm"
+
+	configName = "config"
+)
+
+// ErrNotInitialized is returned by Open for an index that has no repository config
+var ErrNotInitialized = errors.New("repository not initialized, run backup-tool init first")
+
+// PassphraseFunc is called when the passphrase is needed, confirm is set when a new key gets created
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// Config describes a repository. It's stored in the index and encrypted in the block store.
+type Config struct {
+	ID          string            `json:"id"`
+	Version     int               `json:"version"`
+	Storage     string            `json:"storage"`
+	Cipher      string            `json:"cipher"`
+	KDF         *aes256.KDFParams `json:"kdf"`
+	Chunker     string            `json:"chunker"`
+	Blocksize   int               `json:"blocksize"`
+	ChunkMin    int               `json:"chunkmin"`
+	ChunkAvg    int               `json:"chunkavg"`
+	ChunkMax    int               `json:"chunkmax"`
+	Compression string            `json:"compression"`
+}
+
+// configObject is the layout of the config object in the block store. The ID and KDF parameters
+// are kept in plain so the master key can be derived from the block store alone.
+type configObject struct {
+	ID      string            `json:"id"`
+	Version int               `json:"version"`
+	KDF     *aes256.KDFParams `json:"kdf"`
+	Data    []byte            `json:"data"`
+}
+
+// configPayload is the encrypted part of the config object
+type configPayload struct {
+	Config *Config `json:"config"`
+	IDKey  []byte  `json:"idkey"`
+}
+
+// Repository ties the index, the block store and the keys together
+type Repository struct {
+	DB      *sql.DB
+	Storage storage.Storage
+	Config  *Config
+
+	masterKey []byte
+	idKey     []byte
+}
+
+func loadConfig(database *sql.DB) (*Config, error) {
+	encodedConfig, err := sqlite.GetMetadata(database, configName)
+	if err != nil {
+		return nil, err
+	}
+	if encodedConfig == nil {
+		return nil, nil
+	}
+
+	config := &Config{}
+	if err = json.Unmarshal(encodedConfig, config); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return config, nil
+}
+
+// Init creates a repository in the index at dbpath and the block store at config.Storage.
+// An existing index without config is adopted, its keys and blocks are kept.
+func Init(dbpath string, config *Config, passphrase PassphraseFunc) (*Repository, error) {
+	database, err := sqlite.InitDB(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := loadConfig(database)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	if existing != nil {
+		database.Close()
+		return nil, fmt.Errorf("%s already belongs to repository %s", dbpath, existing.ID)
+	}
+
+	store, err := storage.Open(config.Storage)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	// credentials in the location are only used to open the store, they aren't recorded
+	config.Storage = storage.Redact(config.Storage)
+	r := &Repository{DB: database, Storage: store, Config: config}
+
+	exists, err := store.Exists(configName)
+	if err == nil && exists {
+		err = fmt.Errorf("%s already holds a repository", config.Storage)
+	}
+	if err == nil {
+		err = r.loadKeys(passphrase)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		r.Close()
+		return nil, err
+	}
+	config.ID = hex.EncodeToString(id)
+	config.Version = Version
+	config.Cipher = Cipher
+	config.KDF, err = r.kdfParams()
+	if err == nil {
+		err = r.saveConfig()
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	log.Infof("Initialised repository %s", config.ID)
+
+	return r, nil
+}
+
+// Open opens the repository whose index is at dbpath. The block store location recorded
+// in the config can be overridden with blockpath, but it has to hold the same repository.
+func Open(dbpath string, blockpath string, passphrase PassphraseFunc) (*Repository, error) {
+	database, err := sqlite.InitDB(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := loadConfig(database)
+	if err == nil && config == nil {
+		err = ErrNotInitialized
+	}
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	location := config.Storage
+	if blockpath != "" {
+		location = blockpath
+	}
+	store, err := storage.Open(location)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	r := &Repository{DB: database, Storage: store, Config: config}
+
+	if err = r.loadKeys(passphrase); err == nil {
+		err = r.checkStorage(storage.Redact(location))
+	}
+	if err == nil && storage.Redact(config.Storage) != config.Storage {
+		// repositories initialised before credentials were stripped
+		log.Warnf("Removing the credentials from the recorded block location, provide them through the environment from now on")
+		config.Storage = storage.Redact(config.Storage)
+		err = r.saveConfig()
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Repository) saveConfig() error {
+	encodedConfig, err := json.Marshal(r.Config)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&configPayload{Config: r.Config, IDKey: r.idKey})
+	if err != nil {
+		return err
+	}
+	data, err := aes256.WrapKey(payload, r.masterKey)
+	if err != nil {
+		return err
+	}
+	object, err := json.Marshal(&configObject{ID: r.Config.ID, Version: Version, KDF: r.Config.KDF, Data: data})
+	if err != nil {
+		return err
+	}
+
+	if err = r.Storage.Put(configName, object); err != nil {
+		return err
+	}
+	return sqlite.SetMetadata(r.DB, configName, encodedConfig)
+}
+
+// checkStorage makes sure the block store belongs to the same repository as the index
+func (r *Repository) checkStorage(location string) error {
+	object, err := getConfigObject(r.Storage)
+	if err == storage.ErrNotExist {
+		return fmt.Errorf("%s holds no repository", location)
+	}
+	if err != nil {
+		return err
+	}
+	if object.ID != r.Config.ID {
+		return fmt.Errorf("%s belongs to repository %s, the index to %s", location, object.ID, r.Config.ID)
+	}
+
+	_, _, err = readConfigObject(object, r.masterKey)
+	return err
+}
+
+func getConfigObject(store storage.Storage) (*configObject, error) {
+	encodedObject, err := store.Get(configName)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &configObject{}
+	if err = json.Unmarshal(encodedObject, object); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return object, nil
+}
+
+func readConfigObject(object *configObject, masterKey []byte) (*Config, []byte, error) {
+	encodedPayload, err := aes256.UnwrapKey(object.Data, masterKey)
+	if err != nil {
+		return nil, nil, errors.New("can't decrypt repository config, wrong passphrase?")
+	}
+
+	payload := &configPayload{}
+	if err = json.Unmarshal(encodedPayload, payload); err != nil {
+		return nil, nil, err
+	}
+	return payload.Config, payload.IDKey, nil
+}
+
+// Close closes the block store and the index
+func (r *Repository) Close() error {
+	err := r.Storage.Close()
+	if dbErr := r.DB.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
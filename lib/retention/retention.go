@@ -0,0 +1,136 @@
+package retention
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+// Policy describes which backups to keep. Backups are grouped by name and every rule keeps
+// the newest backup of each of the last N hours, days, ... it applies to.
+type Policy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// Within keeps all backups made within this duration before the newest backup
+	Within time.Duration
+}
+
+// Empty reports whether the policy has no rules at all
+func (p *Policy) Empty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0 && p.Yearly == 0 && p.Within == 0
+}
+
+var durationPattern = regexp.MustCompile(`^(\d+)([hdwmy])$`)
+
+// ParseDuration parses durations like 36h, 7d, 4w, 6m or 1y on top of what time.ParseDuration accepts.
+// Months count as 30 and years as 365 days.
+func ParseDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil {
+		return time.ParseDuration(value)
+	}
+
+	count, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, err
+	}
+	day := 24 * time.Hour
+	unit := map[string]time.Duration{"h": time.Hour, "d": day, "w": 7 * day, "m": 30 * day, "y": 365 * day}[match[2]]
+	return time.Duration(count) * unit, nil
+}
+
+// Expired reports whether the expiration of a backup has passed, backups without one never expire
+func Expired(backup *model.Backup, now time.Time) bool {
+	return backup.Expiration != 0 && int64(backup.Expiration) <= now.Unix()
+}
+
+type bucketRule struct {
+	count  int
+	bucket func(t time.Time) string
+}
+
+// Apply splits backups into the ones to keep and the ones to forget. Expired backups are always
+// forgotten, an empty policy keeps all other backups.
+func Apply(policy *Policy, backups []*model.Backup, now time.Time) (keep []*model.Backup, forget []*model.Backup) {
+	groups := make(map[string][]*model.Backup)
+	names := make([]string, 0)
+	for _, backup := range backups {
+		if _, ok := groups[backup.Name]; !ok {
+			names = append(names, backup.Name)
+		}
+		groups[backup.Name] = append(groups[backup.Name], backup)
+	}
+
+	for _, name := range names {
+		group := groups[name]
+		sort.SliceStable(group, func(i, j int) bool {
+			if group[i].Timestamp != group[j].Timestamp {
+				return group[i].Timestamp > group[j].Timestamp
+			}
+			return group[i].ID > group[j].ID
+		})
+
+		kept := keepSet(policy, group)
+		for _, backup := range group {
+			if Expired(backup, now) || (!policy.Empty() && !kept[backup]) {
+				forget = append(forget, backup)
+			} else {
+				keep = append(keep, backup)
+			}
+		}
+	}
+	return keep, forget
+}
+
+// keepSet returns the backups of group the policy keeps, group has to be sorted newest first
+func keepSet(policy *Policy, group []*model.Backup) map[*model.Backup]bool {
+	rules := []bucketRule{
+		{policy.Last, nil},
+		{policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	kept := make(map[*model.Backup]bool)
+	for _, rule := range rules {
+		remaining := rule.count
+		last := ""
+		for index, backup := range group {
+			if remaining <= 0 {
+				break
+			}
+			key := strconv.Itoa(index)
+			if rule.bucket != nil {
+				key = rule.bucket(time.Unix(int64(backup.Timestamp), 0))
+			}
+			if key != last {
+				kept[backup] = true
+				remaining--
+				last = key
+			}
+		}
+	}
+
+	if policy.Within > 0 && len(group) > 0 {
+		newest := time.Unix(int64(group[0].Timestamp), 0)
+		for _, backup := range group {
+			if newest.Sub(time.Unix(int64(backup.Timestamp), 0)) <= policy.Within {
+				kept[backup] = true
+			}
+		}
+	}
+	return kept
+}
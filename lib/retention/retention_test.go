@@ -0,0 +1,118 @@
+package retention
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+func TestParseDuration(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"36h", 36 * time.Hour, false},
+		{"90d", 90 * day, false},
+		{"4w", 28 * day, false},
+		{"6m", 180 * day, false},
+		{"1y", 365 * day, false},
+		{"0d", 0, false},
+		{"90m30s", 90*time.Minute + 30*time.Second, false},
+		{"1.5h", 90 * time.Minute, false},
+		{"1y2m", 0, true},
+		{"d", 0, true},
+		{"-1d", 0, true},
+		{"7 d", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseDuration(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("ParseDuration(%q) returned error %v", test.value, err)
+		} else if got != test.want {
+			t.Errorf("ParseDuration(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// backupAt returns a backup of name n with the given ID made at day and hour of January 2024, local time
+func backupAt(id int, day int, hour int) *model.Backup {
+	return &model.Backup{ID: id, Name: "n", Timestamp: int(time.Date(2024, time.January, day, hour, 0, 0, 0, time.Local).Unix())}
+}
+
+func ids(backups []*model.Backup) string {
+	list := make([]int, 0, len(backups))
+	for _, backup := range backups {
+		list = append(list, backup.ID)
+	}
+	sort.Ints(list)
+	parts := make([]string, 0, len(list))
+	for _, id := range list {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestApply(t *testing.T) {
+	now := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.Local)
+	expired := backupAt(9, 15, 12)
+	expired.Expiration = int(now.Add(-time.Hour).Unix())
+	notYetExpired := backupAt(9, 15, 12)
+	notYetExpired.Expiration = int(now.Add(time.Hour).Unix())
+
+	// two backups on each of the 10th, 11th and 12th
+	spread := []*model.Backup{
+		backupAt(1, 10, 8), backupAt(2, 10, 20),
+		backupAt(3, 11, 8), backupAt(4, 11, 20),
+		backupAt(5, 12, 8), backupAt(6, 12, 20),
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		backups []*model.Backup
+		keep    string
+		forget  string
+	}{
+		{"empty policy keeps everything", Policy{}, spread, "1 2 3 4 5 6", ""},
+		{"last", Policy{Last: 2}, spread, "5 6", "1 2 3 4"},
+		{"daily keeps the newest of each day", Policy{Daily: 2}, spread, "4 6", "1 2 3 5"},
+		{"more buckets than backups", Policy{Daily: 10}, spread, "2 4 6", "1 3 5"},
+		{"overlapping rules keep the union", Policy{Last: 2, Daily: 3}, spread, "2 4 5 6", "1 3"},
+		{"overlapping rules on the same backup", Policy{Last: 1, Daily: 1, Weekly: 1, Monthly: 1, Yearly: 1}, spread, "6", "1 2 3 4 5"},
+		{"hourly", Policy{Hourly: 3}, spread, "4 5 6", "1 2 3"},
+		{"within", Policy{Within: 35 * time.Hour}, spread, "4 5 6", "1 2 3"},
+		{"within includes its limit", Policy{Within: 36 * time.Hour}, spread, "3 4 5 6", "1 2"},
+		{"within is relative to the newest backup", Policy{Within: 12 * time.Hour}, spread, "5 6", "1 2 3 4"},
+		{"within and last", Policy{Last: 4, Within: time.Hour}, spread, "3 4 5 6", "1 2"},
+		{"ties in one bucket keep the higher ID", Policy{Daily: 1}, []*model.Backup{backupAt(1, 10, 8), backupAt(2, 10, 8)}, "2", "1"},
+		{"ties in last keep the higher ID", Policy{Last: 1}, []*model.Backup{backupAt(2, 10, 8), backupAt(1, 10, 8)}, "2", "1"},
+		{"expired without a policy", Policy{}, []*model.Backup{backupAt(1, 10, 8), expired}, "1", "9"},
+		{"expired even when a rule keeps it", Policy{Last: 5}, []*model.Backup{backupAt(1, 10, 8), expired}, "1", "9"},
+		{"expiring later", Policy{}, []*model.Backup{notYetExpired}, "9", ""},
+	}
+	for _, test := range tests {
+		keep, forget := Apply(&test.policy, test.backups, now)
+		if ids(keep) != test.keep || ids(forget) != test.forget {
+			t.Errorf("%s: kept %q and forgot %q, want %q and %q", test.name, ids(keep), ids(forget), test.keep, test.forget)
+		}
+	}
+}
+
+func TestApplyGroupsByName(t *testing.T) {
+	now := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.Local)
+	other := backupAt(7, 1, 8)
+	other.Name = "other"
+	backups := []*model.Backup{backupAt(1, 10, 8), backupAt(2, 11, 8), other}
+
+	keep, forget := Apply(&Policy{Last: 1}, backups, now)
+	if ids(keep) != "2 7" || ids(forget) != "1" {
+		t.Errorf("kept %q and forgot %q, want the newest backup of each name", ids(keep), ids(forget))
+	}
+}
@@ -0,0 +1,209 @@
+package sparse
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+// Holes returns the holes of the first size bytes of f as reported by SEEK_DATA and SEEK_HOLE.
+// Filesystems without support report none. The file offset is reset to the start.
+func Holes(f *os.File, size int64) ([]model.Hole, error) {
+	holes := make([]model.Hole, 0)
+	fd := int(f.Fd())
+
+	offset := int64(0)
+	for offset < size {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// nothing but a hole up to the end of the file
+			data = size
+		} else if err == unix.EINVAL || err == unix.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if data > size {
+			data = size
+		}
+		if data > offset {
+			holes = append(holes, model.Hole{Offset: offset, Length: data - offset})
+		}
+		if data >= size {
+			break
+		}
+
+		offset, err = unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	return holes, err
+}
+
+// DataReader reads the first size bytes of r leaving out the holes
+func DataReader(r io.ReaderAt, size int64, holes []model.Hole) io.Reader {
+	readers := make([]io.Reader, 0, len(holes)+1)
+	offset := int64(0)
+	for _, hole := range holes {
+		if hole.Offset > offset {
+			readers = append(readers, io.NewSectionReader(r, offset, hole.Offset-offset))
+		}
+		offset = hole.Offset + hole.Length
+	}
+	if size > offset {
+		readers = append(readers, io.NewSectionReader(r, offset, size-offset))
+	}
+	return io.MultiReader(readers...)
+}
+
+// Writer puts the holes back into data read through DataReader. Holes are written as zeros,
+// a Writer for a file seeks over them instead.
+type Writer struct {
+	w     io.Writer
+	file  *os.File
+	holes []model.Hole
+	// start is the file offset the data begins at, offset the position within the data
+	start  int64
+	offset int64
+}
+
+// NewWriter returns a Writer writing the holes of data as zeros
+func NewWriter(w io.Writer, holes []model.Hole) *Writer {
+	return &Writer{w: w, holes: holes}
+}
+
+// NewFileWriter returns a Writer leaving holes in f starting at its current offset.
+// f must be a regular file not opened for appending.
+func NewFileWriter(f *os.File, holes []model.Hole) (*Writer, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: f, file: f, holes: holes, start: start}, nil
+}
+
+func (sw *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := sw.skipHoles(); err != nil {
+			return written, err
+		}
+
+		n := len(p)
+		if len(sw.holes) > 0 && sw.holes[0].Offset-sw.offset < int64(n) {
+			n = int(sw.holes[0].Offset - sw.offset)
+		}
+		m, err := sw.w.Write(p[:n])
+		written += m
+		sw.offset += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// skipHoles skips the holes starting at the current offset
+func (sw *Writer) skipHoles() error {
+	for len(sw.holes) > 0 && sw.holes[0].Offset <= sw.offset {
+		length := sw.holes[0].Offset + sw.holes[0].Length - sw.offset
+		sw.holes = sw.holes[1:]
+		if length <= 0 {
+			continue
+		}
+
+		if sw.file != nil {
+			if _, err := sw.file.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		} else if _, err := io.CopyN(sw.w, zeros{}, length); err != nil {
+			return err
+		}
+		sw.offset += length
+	}
+	return nil
+}
+
+// Finish writes the holes at the end of the data. A file is extended to size so a trailing hole
+// is kept, objects of older backups don't know their size and never get truncated.
+func (sw *Writer) Finish(size int64) error {
+	if err := sw.skipHoles(); err != nil {
+		return err
+	}
+	if sw.file != nil && size > 0 {
+		return sw.file.Truncate(sw.start + max(size, sw.offset))
+	}
+	return nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// ReaderAt reads a sparse file out of its data as returned by DataReader, holes read as zeros
+type ReaderAt struct {
+	data  io.ReaderAt
+	size  int64
+	holes []model.Hole
+}
+
+// NewReaderAt returns a ReaderAt for a file of size bytes with the given holes
+func NewReaderAt(data io.ReaderAt, size int64, holes []model.Hole) *ReaderAt {
+	return &ReaderAt{data: data, size: size, holes: holes}
+}
+
+func (sr *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < sr.size {
+		// the data before off and the first hole not ending before it
+		dataOffset := off
+		var next *model.Hole
+		for i := range sr.holes {
+			if sr.holes[i].Offset+sr.holes[i].Length <= off {
+				dataOffset -= sr.holes[i].Length
+				continue
+			}
+			next = &sr.holes[i]
+			break
+		}
+
+		end := sr.size
+		if next != nil && next.Offset <= off {
+			end = next.Offset + next.Length
+		} else if next != nil {
+			end = next.Offset
+		}
+		length := int(min(end-off, int64(len(p)-n)))
+
+		if next != nil && next.Offset <= off {
+			clear(p[n : n+length])
+		} else {
+			m, err := sr.data.ReadAt(p[n:n+length], dataOffset)
+			if m < length {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n + m, err
+			}
+		}
+		n += length
+		off += int64(length)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,155 @@
+package local
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	storage.Register("file", func(location *url.URL) (storage.Storage, error) {
+		// accept file://relative/path and file:relative/path as well
+		return New(location.Host + location.Path + location.Opaque)
+	})
+}
+
+// Local stores objects in a directory on the local filesystem
+type Local struct {
+	basepath string
+}
+
+// New returns a Local storage rooted at basepath, creating the directory if needed
+func New(basepath string) (*Local, error) {
+	if basepath == "" {
+		return nil, errors.New("local: no base path given")
+	}
+	if err := os.MkdirAll(basepath, 0755); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return &Local{basepath: basepath}, nil
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.basepath, filepath.FromSlash(storage.Path(name)))
+}
+
+func (l *Local) Put(name string, data []byte) error {
+	log.WithFields(log.Fields{
+		"name": name,
+		"size": len(data),
+	}).Debug("Writing object")
+
+	objectpath := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(objectpath), 0755); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated object behind
+	tmpfile, err := ioutil.TempFile(filepath.Dir(objectpath), ".tmp-")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err = tmpfile.Write(data); err != nil {
+		log.Error(err)
+		tmpfile.Close()
+		return err
+	}
+	if err = tmpfile.Close(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err = os.Rename(tmpfile.Name(), objectpath); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Get(name string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"name": name,
+	}).Debug("Reading object")
+
+	data, err := ioutil.ReadFile(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (l *Local) Exists(name string) (bool, error) {
+	_, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *Local) Delete(name string) error {
+	err := os.Remove(l.path(name))
+	if os.IsNotExist(err) {
+		return storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (l *Local) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(l.basepath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Base(path)[0] == '.' {
+			return nil
+		}
+		relpath, err := filepath.Rel(l.basepath, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, storage.NameFromPath(filepath.ToSlash(relpath)))
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	return names, err
+}
+
+func (l *Local) Stat(name string) (int64, error) {
+	info, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) {
+		return 0, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
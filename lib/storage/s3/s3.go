@@ -0,0 +1,229 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPartSize is the size of the parts blocks are uploaded in.
+// With the default blocksize of 50 MiB a block is uploaded in four parts.
+const DefaultPartSize = 16 * 1024 * 1024
+
+func init() {
+	storage.Register("s3", Open)
+}
+
+// S3 stores objects in a bucket of an S3 compatible object storage
+type S3 struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// Open returns an S3 storage for a location like
+// s3://access:secret@minio.example.com:9000/bucket/prefix?secure=false&region=us-east-1&partsize=16777216.
+// Without credentials in the URL they are taken from the AWS_* or MINIO_* environment variables
+// or ~/.aws/credentials. Credentials in the URL are stripped before the location is recorded.
+func Open(location *url.URL) (storage.Storage, error) {
+	parts := strings.SplitN(strings.Trim(location.Path, "/"), "/", 2)
+	if location.Host == "" || parts[0] == "" {
+		return nil, errors.New("s3: location must be s3://endpoint/bucket[/prefix]")
+	}
+
+	query := location.Query()
+	secure := true
+	if value := query.Get("secure"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		secure = parsed
+	}
+
+	partSize := uint64(DefaultPartSize)
+	if value := query.Get("partsize"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		partSize = parsed
+	}
+
+	// credentials in the URL aren't recorded in the repository, so they are only
+	// meant for init and one-off overrides, normally they come from the environment
+	var creds *credentials.Credentials
+	if password, ok := location.User.Password(); ok {
+		creds = credentials.NewStaticV4(location.User.Username(), password, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+		})
+	}
+
+	client, err := minio.New(location.Host, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: query.Get("region"),
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	s := &S3{
+		client:   client,
+		bucket:   parts[0],
+		partSize: partSize,
+	}
+	if len(parts) > 1 {
+		s.prefix = parts[1]
+	}
+
+	exists, err := client.BucketExists(context.Background(), s.bucket)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(context.Background(), s.bucket, minio.MakeBucketOptions{Region: query.Get("region")})
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		log.Debugf("Created bucket %s", s.bucket)
+	}
+
+	return s, nil
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.prefix, storage.Path(name))
+}
+
+func isNotExist(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s *S3) Put(name string, data []byte) error {
+	log.WithFields(log.Fields{
+		"name": name,
+		"size": len(data),
+	}).Debug("Uploading object")
+
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    s.partSize,
+			// blocks are authenticated by AES-GCM already, skipping the payload signature
+			// avoids chunked streaming uploads some S3 implementations don't understand
+			DisableContentSha256: true,
+		})
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (s *S3) Get(name string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"name": name,
+	}).Debug("Downloading object")
+
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	if isNotExist(err) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *S3) Exists(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if err == storage.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3) Delete(name string) error {
+	// RemoveObject succeeds for missing keys, so check first to honour the Storage contract
+	exists, err := s.Exists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return storage.ErrNotExist
+	}
+
+	err = s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (s *S3) List() ([]string, error) {
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var names []string
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			log.Error(object.Err)
+			return nil, object.Err
+		}
+		names = append(names, storage.NameFromPath(strings.TrimPrefix(object.Key, prefix)))
+	}
+	return names, nil
+}
+
+func (s *S3) Stat(name string) (int64, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if isNotExist(err) {
+		return 0, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+)
+
+// openFake starts an in-process S3 server and opens a storage for bucket/prefix on it
+func openFake(t *testing.T, server *httptest.Server, bucketPrefix string) storage.Storage {
+	t.Helper()
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse("s3://access:secret@" + endpoint.Host + "/" + bucketPrefix + "?secure=false&region=us-east-1&partsize=5242880")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newFakeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPutGetMultipart(t *testing.T) {
+	s := openFake(t, newFakeServer(t), "bucket/repo")
+
+	// bigger than two parts of 5 MiB
+	data := make([]byte, 12*1024*1024+17)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	name := "0a1b2c3d4e5f"
+	if err := s.Put(name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Get returned %d bytes differing from the %d put", len(read), len(data))
+	}
+	size, err := s.Stat(name)
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("Stat returned %d, %v, want %d", size, err, len(data))
+	}
+	if exists, err := s.Exists(name); err != nil || !exists {
+		t.Errorf("Exists returned %v, %v", exists, err)
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	server := newFakeServer(t)
+	repo := openFake(t, server, "bucket/repo")
+	other := openFake(t, server, "bucket/other")
+
+	for _, name := range []string{"config", "manifests/0011", "abcdef0123"} {
+		if err := repo.Put(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Put("config", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := repo.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	want := []string{"abcdef0123", "config", "manifests/0011"}
+	if len(names) != len(want) {
+		t.Fatalf("List returned %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("List returned %q, want %q", names, want)
+			break
+		}
+	}
+
+	data, err := other.Get("config")
+	if err != nil || string(data) != "other" {
+		t.Errorf("Get of the other prefix returned %q, %v", data, err)
+	}
+}
+
+func TestNotExist(t *testing.T) {
+	s := openFake(t, newFakeServer(t), "bucket")
+
+	if _, err := s.Get("missing"); err != storage.ErrNotExist {
+		t.Errorf("Get returned %v, want ErrNotExist", err)
+	}
+	if _, err := s.Stat("missing"); err != storage.ErrNotExist {
+		t.Errorf("Stat returned %v, want ErrNotExist", err)
+	}
+	if err := s.Delete("missing"); err != storage.ErrNotExist {
+		t.Errorf("Delete returned %v, want ErrNotExist", err)
+	}
+	if exists, err := s.Exists("missing"); err != nil || exists {
+		t.Errorf("Exists returned %v, %v", exists, err)
+	}
+
+	if err := s.Put("present", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("present"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("present"); err != storage.ErrNotExist {
+		t.Errorf("Get after Delete returned %v, want ErrNotExist", err)
+	}
+}
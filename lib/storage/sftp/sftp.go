@@ -0,0 +1,364 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	storage.Register("sftp", Open)
+}
+
+// SFTP stores objects in a directory on a remote host reached via SSH.
+// One SSH connection is used for the lifetime of the storage.
+type SFTP struct {
+	conn     *ssh.Client
+	client   *sftp.Client
+	basepath string
+}
+
+// authMethods returns the ssh agent and key file authentication. The agent connection is only
+// needed during the handshake and has to be closed by the caller.
+func authMethods(keyfile string) ([]ssh.AuthMethod, io.Closer, error) {
+	var methods []ssh.AuthMethod
+	var agentConn io.Closer
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Warnf("Can't connect to ssh agent: %s", err)
+		} else {
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	keyfiles := []string{keyfile}
+	if keyfile == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			closeAgent(agentConn)
+			return nil, nil, err
+		}
+		keyfiles = []string{
+			filepath.Join(home, ".ssh", "id_ed25519"),
+			filepath.Join(home, ".ssh", "id_ecdsa"),
+			filepath.Join(home, ".ssh", "id_rsa"),
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range keyfiles {
+		key, err := ioutil.ReadFile(file)
+		if err != nil {
+			if keyfile != "" {
+				closeAgent(agentConn)
+				return nil, nil, err
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			if keyfile != "" {
+				closeAgent(agentConn)
+				return nil, nil, err
+			}
+			log.Warnf("Can't use key %s: %s", file, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("sftp: no ssh agent or usable key file found")
+	}
+	return methods, agentConn, nil
+}
+
+func closeAgent(conn io.Closer) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func hostKeyCallback(knownHostsFile string, insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		log.Warn("Not verifying the ssh host key")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if knownHostsFile == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(knownHostsFile)
+}
+
+// Open returns an SFTP storage for a location like
+// sftp://user@backup.example.com:22/srv/blocks?key=/root/.ssh/id_backup&known_hosts=/root/.ssh/known_hosts.
+// Authentication uses the ssh agent and the given or default key files, the host key is checked
+// against known_hosts unless insecure=true is set.
+func Open(location *url.URL) (storage.Storage, error) {
+	if location.Host == "" {
+		return nil, errors.New("sftp: location must be sftp://[user@]host[:port]/path")
+	}
+
+	query := location.Query()
+	insecure := false
+	if value := query.Get("insecure"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		insecure = parsed
+	}
+
+	methods, agentConn, err := authMethods(query.Get("key"))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer closeAgent(agentConn)
+	callback, err := hostKeyCallback(query.Get("known_hosts"), insecure)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	username := ""
+	if location.User != nil {
+		username = location.User.Username()
+	} else if u := os.Getenv("USER"); u != "" {
+		username = u
+	}
+
+	address := location.Host
+	if location.Port() == "" {
+		address = net.JoinHostPort(location.Hostname(), "22")
+	}
+
+	return Dial(address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            methods,
+		HostKeyCallback: callback,
+	}, location.Path)
+}
+
+// Dial connects to address and returns an SFTP storage rooted at basepath
+func Dial(address string, config *ssh.ClientConfig, basepath string) (*SFTP, error) {
+	conn, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		log.Error(err)
+		conn.Close()
+		return nil, err
+	}
+
+	if basepath == "" {
+		basepath = "."
+	}
+	if err = client.MkdirAll(basepath); err != nil {
+		log.Error(err)
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	log.Debugf("Connected to %s", address)
+
+	return &SFTP{conn: conn, client: client, basepath: basepath}, nil
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.basepath, storage.Path(name))
+}
+
+func (s *SFTP) Put(name string, data []byte) error {
+	log.WithFields(log.Fields{
+		"name": name,
+		"size": len(data),
+	}).Debug("Uploading object")
+
+	objectpath := s.path(name)
+	if err := s.client.MkdirAll(path.Dir(objectpath)); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// write to a temporary file first so an aborted upload never leaves a truncated object behind,
+	// the random suffix keeps concurrent uploads of the same object apart
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	tmppath := path.Join(path.Dir(objectpath), ".tmp-"+path.Base(objectpath)+"-"+suffix)
+	f, err := s.client.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		log.Error(err)
+		f.Close()
+		s.client.Remove(tmppath)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		log.Error(err)
+		s.client.Remove(tmppath)
+		return err
+	}
+
+	if err = s.client.PosixRename(tmppath, objectpath); err != nil {
+		err = s.replace(tmppath, objectpath, suffix)
+	}
+	if err != nil {
+		log.Error(err)
+		s.client.Remove(tmppath)
+	}
+	return err
+}
+
+// replace renames tmppath to objectpath on servers without the posix-rename extension, which refuse
+// to overwrite existing files. An existing object is moved aside first and put back if that fails.
+func (s *SFTP) replace(tmppath string, objectpath string, suffix string) error {
+	oldpath := path.Join(path.Dir(objectpath), ".old-"+path.Base(objectpath)+"-"+suffix)
+	err := s.client.Rename(objectpath, oldpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+
+	if err = s.client.Rename(tmppath, objectpath); err != nil {
+		if existed {
+			if restoreErr := s.client.Rename(oldpath, objectpath); restoreErr != nil {
+				log.Errorf("Can't move %s back to %s: %s", oldpath, objectpath, restoreErr)
+			}
+		}
+		return err
+	}
+	if existed {
+		if err = s.client.Remove(oldpath); err != nil {
+			log.Warnf("Can't remove %s: %s", oldpath, err)
+		}
+	}
+	return nil
+}
+
+func randomSuffix() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return hex.EncodeToString(suffix), nil
+}
+
+func (s *SFTP) Get(name string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"name": name,
+	}).Debug("Downloading object")
+
+	f, err := s.client.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *SFTP) Exists(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if err == storage.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SFTP) Delete(name string) error {
+	err := s.client.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (s *SFTP) List() ([]string, error) {
+	var names []string
+	walker := s.client.Walk(s.basepath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if walker.Stat().IsDir() || strings.HasPrefix(path.Base(walker.Path()), ".") {
+			continue
+		}
+		relpath := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.basepath), "/")
+		names = append(names, storage.NameFromPath(relpath))
+	}
+	return names, nil
+}
+
+func (s *SFTP) Stat(name string) (int64, error) {
+	info, err := s.client.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return 0, storage.ErrNotExist
+	}
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *SFTP) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
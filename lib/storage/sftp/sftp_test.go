@@ -0,0 +1,245 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gentoomaniac/backup-tool/lib/storage"
+)
+
+// startServer runs an SSH server with the sftp subsystem on a loopback port accepting clientKey
+func startServer(t *testing.T, clientKey ssh.PublicKey) string {
+	t.Helper()
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					server.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// dial starts a server and connects a storage to a fresh directory on it
+func dial(t *testing.T) (*SFTP, string) {
+	t.Helper()
+	_, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := startServer(t, clientSigner.PublicKey())
+
+	basepath := filepath.Join(t.TempDir(), "blocks")
+	s, err := Dial(address, &ssh.ClientConfig{
+		User:            "backup",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, basepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, basepath
+}
+
+func TestPutGetListDelete(t *testing.T) {
+	s, _ := dial(t)
+
+	objects := map[string][]byte{
+		"config":         []byte("config"),
+		"manifests/0011": []byte("manifest"),
+		"abcdef0123":     bytes.Repeat([]byte("block"), 100000),
+	}
+	for name, data := range objects {
+		if err := s.Put(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range objects {
+		read, err := s.Get(name)
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("Get(%s) returned %d bytes, %v", name, len(read), err)
+		}
+		size, err := s.Stat(name)
+		if err != nil || size != int64(len(data)) {
+			t.Errorf("Stat(%s) returned %d, %v", name, size, err)
+		}
+	}
+
+	names, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "abcdef0123 config manifests/0011" {
+		t.Errorf("List returned %q", names)
+	}
+
+	if err := s.Put("config", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := s.Get("config"); string(data) != "replaced" {
+		t.Errorf("Get after overwriting returned %q", data)
+	}
+
+	if err := s.Delete("config"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("config"); err != storage.ErrNotExist {
+		t.Errorf("Get returned %v, want ErrNotExist", err)
+	}
+	if _, err := s.Stat("config"); err != storage.ErrNotExist {
+		t.Errorf("Stat returned %v, want ErrNotExist", err)
+	}
+	if err := s.Delete("config"); err != storage.ErrNotExist {
+		t.Errorf("Delete returned %v, want ErrNotExist", err)
+	}
+	if exists, err := s.Exists("config"); err != nil || exists {
+		t.Errorf("Exists returned %v, %v", exists, err)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	s, basepath := dial(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.Put("config", bytes.Repeat([]byte{byte('a' + i)}, 100000)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := s.Get("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 100000 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+		t.Errorf("concurrent uploads mixed up the object")
+	}
+
+	entries, err := os.ReadDir(basepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestReplaceKeepsObjectOnFailure(t *testing.T) {
+	s, basepath := dial(t)
+	if err := s.Put("config", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary file doesn't exist, so moving it into place fails
+	if err := s.replace(s.path(".tmp-missing"), s.path("config"), "test"); err == nil {
+		t.Fatal("replace succeeded without a temporary file")
+	}
+	if data, err := s.Get("config"); err != nil || string(data) != "original" {
+		t.Errorf("Get after a failed replace returned %q, %v", data, err)
+	}
+
+	tmppath := s.path(".tmp-new")
+	f, err := s.client.Create(tmppath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if err := s.replace(tmppath, s.path("config"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Get("config"); err != nil || string(data) != "new" {
+		t.Errorf("Get after replace returned %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(basepath); len(entries) != 1 {
+		t.Errorf("replace left %d files behind", len(entries))
+	}
+}
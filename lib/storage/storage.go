@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gentoomaniac/backup-tool/lib/model"
+)
+
+// ErrNotExist is returned by a Storage if the requested object does not exist
+var ErrNotExist = errors.New("object does not exist")
+
+// Storage is a place to keep encrypted blocks and other repository objects.
+// Objects are addressed by name, drivers translate names into their own layout via Path.
+type Storage interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Exists(name string) (bool, error)
+	Delete(name string) error
+	List() ([]string, error)
+	Stat(name string) (int64, error)
+	Close() error
+}
+
+// Driver opens a Storage for a parsed location URL
+type Driver func(location *url.URL) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes a storage driver available for the given URL scheme
+func Register(scheme string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("storage: Register driver is nil")
+	}
+	if _, dup := drivers[scheme]; dup {
+		panic("storage: Register called twice for driver " + scheme)
+	}
+	drivers[scheme] = driver
+}
+
+// Drivers returns the sorted list of registered URL schemes
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	schemes := make([]string, 0, len(drivers))
+	for scheme := range drivers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the Storage for a location like file:///srv/blocks.
+// A location without a scheme is treated as a local directory.
+func Open(location string) (Storage, error) {
+	if location == "" {
+		return nil, errors.New("storage: no location given")
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		u = &url.URL{Scheme: "file", Path: location}
+	}
+
+	driversMu.RLock()
+	driver, ok := drivers[u.Scheme]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown driver %q (forgotten import?)", u.Scheme)
+	}
+	return driver(u)
+}
+
+// Redact removes a password from a location so it can be recorded or printed.
+// Drivers take credentials from their environment instead.
+func Redact(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.User == nil {
+		return location
+	}
+	if _, ok := u.User.Password(); !ok {
+		return location
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// BlockName returns the object name a block is stored under
+func BlockName(metadata *model.BlockMeta) string {
+	return hex.EncodeToString(metadata.Name)
+}
+
+// IsBlockName reports whether name looks like a block name as returned by BlockName
+func IsBlockName(name string) bool {
+	if len(name) < 4 || len(name)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// Path returns the slash separated location of an object relative to the storage root.
+// Blocks are fanned out into two directory levels named after the first two bytes of their name,
+// all other objects are stored under their name as is.
+func Path(name string) string {
+	if IsBlockName(name) {
+		return path.Join(name[0:2], name[2:4], name)
+	}
+	return name
+}
+
+// NameFromPath is the inverse of Path
+func NameFromPath(p string) string {
+	parts := strings.Split(p, "/")
+	if len(parts) == 3 && IsBlockName(parts[2]) && parts[0] == parts[2][0:2] && parts[1] == parts[2][2:4] {
+		return parts[2]
+	}
+	return p
+}